@@ -0,0 +1,262 @@
+package reduce
+
+import (
+	"context"
+
+	alog "github.com/apex/log"
+
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
+)
+
+// Accumulator holds the running state of a reduction of all grid cells
+// of a chunk over one date range. Accumulators allocate their state on
+// the first Add after Reset, sized by the chunk data.
+type Accumulator interface {
+	// Add adds the observations of dc, which falls within dr.
+	Add(dr datechan.DateIdxRange, dc griddata.DataChunk)
+	// Emit returns the result for dr. The state must still describe the
+	// same observations afterwards, the window of overlapping ranges
+	// carries over to the next range.
+	Emit(dr datechan.DateIdxRange) []float32
+	// Reset clears the state for a new range.
+	Reset()
+}
+
+// Remover is implemented by Accumulators that can take observations back
+// out, as they leave the window of overlapping date ranges. Chunks are
+// removed in the order they were added. Accumulators that are not
+// Removers are reset and rebuilt from the buffered window for each
+// overlapping range.
+type Remover interface {
+	Remove(dc griddata.DataChunk)
+}
+
+// Checker is implemented by Accumulators that take only some chunks,
+// such as a number of variables. Accumulate returns the error of Check
+// for the first chunk it rejects.
+type Checker interface {
+	Check(dc griddata.DataChunk) error
+}
+
+// CompanionEmitter is implemented by Accumulators with a secondary
+// result, which is sent on Config.Companion after each result.
+type CompanionEmitter interface {
+	EmitCompanion(dr datechan.DateIdxRange) []float32
+}
+
+// AccumulatorFactory returns a Factory for a reduction computed by the
+// accumulators of newAcc, which it also sets as Config.NewAccumulator.
+func AccumulatorFactory(newAcc func(Config) Accumulator) Factory {
+	return func(elem params.Element) (Config, error) {
+		cfg := NewConfig(elem)
+		cfg.NewAccumulator = newAcc
+		cfg.Func = func(ctx context.Context,
+			config Config,
+			drc datechan.DateRangeChannel,
+			inData, outData chan griddata.DataChunk) error {
+
+			return Accumulate(ctx, config, newAcc(config), drc, inData, outData)
+		}
+		return cfg, nil
+	}
+}
+
+// emitRange sends the result of acc for dr, dated and placed as last,
+// the last chunk of the range.
+func emitRange(ctx context.Context,
+	config Config,
+	acc Accumulator,
+	dr datechan.DateIdxRange,
+	last griddata.DataChunk,
+	outData chan griddata.DataChunk) error {
+
+	outDC := griddata.DataChunk{
+		Date:   dr.Resample(last.Date),
+		Offset: last.Offset,
+		Length: last.Length,
+		Data:   acc.Emit(dr)}
+
+	select {
+	case outData <- outDC:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if ce, ok := acc.(CompanionEmitter); ok && config.Companion != nil {
+		outDC.Data = ce.EmitCompanion(dr)
+		select {
+		case config.Companion <- outDC:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Accumulate runs acc over the date ranges of drc, writing one chunk per
+// range to outData, which it closes on return. Overlapping date ranges
+// (config.Overlapping) keep a window of chunks, see Remover.
+//
+// If config.Companion is not nil it is closed on return, and if acc is a
+// CompanionEmitter its secondary result is sent on it after each chunk
+// of outData. The caller must read it concurrently with outData.
+func Accumulate(ctx context.Context,
+	config Config,
+	acc Accumulator,
+	drc datechan.DateRangeChannel,
+	inData, outData chan griddata.DataChunk) error {
+
+	defer close(outData)
+	if config.Companion != nil {
+		defer close(config.Companion)
+	}
+
+	remover, canRemove := acc.(Remover)
+	checker, canCheck := acc.(Checker)
+
+	var (
+		dr              datechan.DateIdxRange
+		last_start      datechan.DateIdx
+		inDC, inDC1     griddata.DataChunk
+		dr_ok, inDC_ok  bool
+		obsCnt          int
+		firstDC, lastDC *dataListItem
+	)
+
+	nextRange := func() error {
+		if obsCnt > 0 {
+			last := inDC1
+			if config.Overlapping {
+				last = lastDC.data
+			}
+			if err := emitRange(ctx, config, acc, dr, last, outData); err != nil {
+				return err
+			}
+			last_start = dr.Start.Copy()
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case dr, dr_ok = <-drc:
+		}
+
+		if !config.Overlapping {
+			if !(dr_ok && dr.Start.Equal(last_start)) {
+				acc.Reset()
+				obsCnt = 0
+			}
+			return nil
+		}
+
+		if dr_ok {
+			for firstDC != nil {
+				if firstDC.data.Date.Less(dr.Start) { // no longer in daterange
+					if canRemove {
+						remover.Remove(firstDC.data)
+					}
+					obsCnt--
+					firstDC = firstDC.next
+					if firstDC == nil {
+						lastDC = nil
+						acc.Reset()
+					}
+				} else {
+					break
+				}
+			}
+			if !canRemove && firstDC != nil {
+				acc.Reset()
+				for item := firstDC; item != nil; item = item.next {
+					acc.Add(dr, item.data)
+				}
+			}
+		} else {
+			// obsCnt is a flag
+			obsCnt = 0
+		}
+		return nil
+	}
+
+	add := func() {
+		acc.Add(dr, inDC)
+		obsCnt++
+		if !config.Overlapping {
+			inDC1 = inDC
+		} else if firstDC == nil {
+			firstDC = &dataListItem{data: inDC}
+			lastDC = firstDC
+		} else {
+			nextDC := &dataListItem{data: inDC}
+			lastDC.next = nextDC
+			lastDC = nextDC
+		}
+	}
+
+	if err := nextRange(); err != nil {
+		return err
+	}
+
+dataLoop:
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case inDC, inDC_ok = <-inData:
+		}
+		if !inDC_ok {
+			break
+		}
+		if canCheck {
+			if err := checker.Check(inDC); err != nil {
+				return err
+			}
+		}
+
+		if inDC.Date.Less(dr.Start) {
+			alog.Debugf("skip %s < %s", inDC.Date.Key(), dr.Start.Key())
+			continue
+		}
+		added := false
+		if inDC.Date.Less(dr.End) || inDC.Date.Equal(dr.End) {
+			add()
+			added = true
+		}
+		if !inDC.Date.Less(dr.End) {
+			for {
+				if err := nextRange(); err != nil {
+					return err
+				}
+				if !dr_ok {
+					break dataLoop
+				}
+				if !dr.End.Less(inDC.Date) {
+					break
+				}
+				alog.Debugf("skip+ %s >= %s", inDC.Date.Key(), dr.End.Key())
+			}
+			// after a gap inDC may fall within the next range
+			if !added && !inDC.Date.Less(dr.Start) {
+				add()
+			}
+		}
+	}
+
+	if err := nextRange(); err != nil {
+		return err
+	}
+
+	// drain data channel??
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case inDC, inDC_ok = <-inData:
+			if !inDC_ok {
+				return nil
+			}
+		}
+	}
+}
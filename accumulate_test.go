@@ -0,0 +1,142 @@
+package reduce
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
+)
+
+// rangeAcc returns max - min of the valid values. It is not a Remover,
+// so overlapping ranges rebuild it from the window.
+type rangeAcc struct {
+	lo, hi []float32
+}
+
+func (a *rangeAcc) Add(dr datechan.DateIdxRange, dc griddata.DataChunk) {
+	if a.lo == nil {
+		a.lo = make([]float32, len(dc.Data))
+		a.hi = make([]float32, len(dc.Data))
+		for idx := range a.lo {
+			a.lo[idx] = float32(math.Inf(1))
+			a.hi[idx] = float32(math.Inf(-1))
+		}
+	}
+	for idx, v := range dc.Data {
+		if v < a.lo[idx] {
+			a.lo[idx] = v
+		}
+		if v > a.hi[idx] {
+			a.hi[idx] = v
+		}
+	}
+}
+
+func (a *rangeAcc) Emit(dr datechan.DateIdxRange) []float32 {
+	res := make([]float32, len(a.lo))
+	for idx := range a.lo {
+		res[idx] = a.hi[idx] - a.lo[idx]
+	}
+	return res
+}
+
+func (a *rangeAcc) Reset() {
+	a.lo = nil
+	a.hi = nil
+}
+
+// test_range is registered once per test binary, the registry panics
+// on duplicates when tests are run more than once.
+func init() {
+	Register("test_range", "test reduction",
+		AccumulatorFactory(func(config Config) Accumulator { return &rangeAcc{} }))
+}
+
+func TestAccumulatorRebuild(t *testing.T) {
+	assert := assert.New(t)
+	cal := &datechan.Gregorian{}
+	ctx := context.Background()
+
+	var elem params.Element
+	jsonBlob := []byte(`{"vX":4, "interval":[0,0,1], "duration":3, "reduce":"test_range"}`)
+	err := json.Unmarshal(jsonBlob, &elem)
+	assert.Nil(err)
+	nan := float32(math.NaN())
+	cfg, err := Setup(elem)
+	assert.Nil(err)
+
+	drCfg := datechan.IDconfig{
+		Interval:      elem.DateIterConfig.Interval,
+		Duration:      elem.DateIterConfig.Duration,
+		Sdate:         []int{2000, 1, 3},
+		Edate:         []int{2000, 1, 6},
+		Calendar:      cal,
+		InResolution:  3,
+		OutResolution: 3,
+	}
+	drCfg.Validate()
+	assert.True(drCfg.IsOverlapping())
+	drc := datechan.New(ctx, drCfg)
+
+	inData := make(chan griddata.DataChunk, 10)
+	outData := make(chan griddata.DataChunk, 0)
+
+	days := [][]float32{
+		{1, nan},
+		{5, 4},
+		{2, 4},
+		{3, nan},
+		{1, 1},
+		{0, 2},
+	}
+	for day, data := range days {
+		inData <- griddata.DataChunk{
+			Date: cal.YMDtoYI([]int{2000, 1, day + 1}),
+			Data: data,
+		}
+	}
+	close(inData)
+	go func() {
+		err := cfg.Func(ctx, cfg, drc, inData, outData)
+		assert.Nil(err)
+	}()
+
+	expected := [][]float32{
+		{4, 0},
+		{3, 0},
+		{2, 3},
+		{3, 1},
+	}
+	for _, exp := range expected {
+		d, ok := <-outData
+		assert.True(ok)
+		assert.Equal(exp, d.Data)
+	}
+	_, ok := <-outData
+	assert.False(ok)
+}
+
+func TestAccumulateGapAtRangeStart(t *testing.T) {
+	days := [][]float32{{1}, {2}, nil, {4}, {5}, {6}}
+
+	res := runDaily(t, `{"vX":4, "interval":[0,0,3], "duration":3, "reduce":"sum","maxMissing":1}`,
+		[]int{2000, 1, 3}, []int{2000, 1, 6}, days)
+	if assert.Len(t, res, 2) {
+		assertData(t, []float32{3}, res[0], "jan 3")
+		assertData(t, []float32{15}, res[1], "jan 6")
+	}
+
+	res = runDaily(t, `{"vX":4, "interval":[0,0,1], "duration":3, "reduce":"mean","maxMissing":1}`,
+		[]int{2000, 1, 3}, []int{2000, 1, 6}, days)
+	if assert.Len(t, res, 4) {
+		assertData(t, []float32{1.5}, res[0], "jan 3")
+		assertData(t, []float32{3}, res[1], "jan 4")
+		assertData(t, []float32{4.5}, res[2], "jan 5")
+		assertData(t, []float32{5}, res[3], "jan 6")
+	}
+}
@@ -0,0 +1,209 @@
+package reduce
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+)
+
+var anomaly_pattern *regexp.Regexp = regexp.MustCompile(`^(anom|pnorm)_(mean|sum)$`)
+
+func init() {
+	RegisterPattern(anomaly_pattern,
+		"departure from normal (anom) or percent of normal (pnorm) of the mean or sum, e.g. anom_mean or pnorm_sum; needs Config.Normals",
+		funcFactory(Anomaly))
+}
+
+// normalKey identifies the normals of the chunk at offset for a month
+// and day, 0 when the date has no such part.
+type normalKey struct {
+	month, day, offset int
+}
+
+// Normals holds the climatology of the anomaly reductions, loaded from
+// chunks keyed by the month and day of their date, see Load.
+//
+// Daily normals hold one chunk per day of the year and are reduced over
+// each range like the observations, for the same days and cells, so a
+// range with missing values is compared to the normal of the days that
+// were observed. The days are those of a leap year: a Feb 29 without its
+// own normal uses the mean of the Feb 28 and Mar 1 normals.
+//
+// Otherwise the normals are those of whole ranges, keyed by the output
+// date of the range, e.g. one chunk per month for monthly ranges.
+type Normals struct {
+	Daily bool
+
+	chunks map[normalKey][]float32
+}
+
+// ymdKey returns the normalKey of the year, month and day ymd.
+func ymdKey(ymd []int, offset int) normalKey {
+	k := normalKey{offset: offset}
+	if len(ymd) > 1 {
+		k.month = ymd[1]
+	}
+	if len(ymd) > 2 {
+		k.day = ymd[2]
+	}
+	return k
+}
+
+// Load reads the normals chunks of in, dated in cal, until it is
+// closed.
+func (n *Normals) Load(ctx context.Context, cal datechan.Calendar, in chan griddata.DataChunk) error {
+	if cal == nil {
+		return fmt.Errorf("normals need a calendar")
+	}
+	if n.chunks == nil {
+		n.chunks = make(map[normalKey][]float32)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case dc, ok := <-in:
+			if !ok {
+				return nil
+			}
+			n.chunks[ymdKey(cal.YItoYMD(dc.Date), dc.Offset)] = dc.Data
+		}
+	}
+}
+
+// day returns the daily normals of k, nil if there are none.
+func (n *Normals) day(k normalKey) []float32 {
+	if data, ok := n.chunks[k]; ok || k.month != 2 || k.day != 29 {
+		return data
+	}
+	feb28 := n.chunks[normalKey{month: 2, day: 28, offset: k.offset}]
+	mar1 := n.chunks[normalKey{month: 3, day: 1, offset: k.offset}]
+	if feb28 == nil || len(feb28) != len(mar1) {
+		return nil
+	}
+	data := make([]float32, len(feb28))
+	for idx := range data {
+		data[idx] = (feb28[idx] + mar1[idx]) / 2
+	}
+	return data
+}
+
+// period returns the normals of the whole range of k, nil if there are
+// none.
+func (n *Normals) period(k normalKey) []float32 {
+	return n.chunks[k]
+}
+
+// anomalyAcc reduces the observations, and for daily normals the normals
+// of the same days and cells, with the sum or mean accumulator.
+type anomalyAcc struct {
+	config    Config
+	pct       bool
+	offset    int
+	obs, norm interface {
+		Accumulator
+		Remover
+	}
+}
+
+func newAnomalyAcc(config Config) *anomalyAcc {
+	m := anomaly_pattern.FindStringSubmatch(config.Name)
+	a := &anomalyAcc{config: config, pct: m[1] == "pnorm"}
+	if m[2] == "sum" {
+		a.obs = &sumAcc{config: config}
+		a.norm = &sumAcc{config: config}
+	} else {
+		a.obs = &meanAcc{sumAcc{config: config}}
+		a.norm = &meanAcc{sumAcc{config: config}}
+	}
+	return a
+}
+
+// split returns the observations of dc with a daily normal and those
+// normals, NaN where either is missing.
+func (a *anomalyAcc) split(dc griddata.DataChunk) (obs, norm griddata.DataChunk) {
+	nan := float32(math.NaN())
+	normals := a.config.Normals.day(ymdKey(a.config.Calendar.YItoYMD(dc.Date), dc.Offset))
+	obs, norm = dc, dc
+	obs.Data = make([]float32, len(dc.Data))
+	norm.Data = make([]float32, len(dc.Data))
+	for idx, v := range dc.Data {
+		if v != v || idx >= len(normals) || normals[idx] != normals[idx] {
+			obs.Data[idx], norm.Data[idx] = nan, nan
+		} else {
+			obs.Data[idx], norm.Data[idx] = v, normals[idx]
+		}
+	}
+	return obs, norm
+}
+
+func (a *anomalyAcc) Add(dr datechan.DateIdxRange, dc griddata.DataChunk) {
+	a.offset = dc.Offset
+	if !a.config.Normals.Daily {
+		a.obs.Add(dr, dc)
+		return
+	}
+	obs, norm := a.split(dc)
+	a.obs.Add(dr, obs)
+	a.norm.Add(dr, norm)
+}
+
+func (a *anomalyAcc) Remove(dc griddata.DataChunk) {
+	if !a.config.Normals.Daily {
+		a.obs.Remove(dc)
+		return
+	}
+	obs, norm := a.split(dc)
+	a.obs.Remove(obs)
+	a.norm.Remove(norm)
+}
+
+func (a *anomalyAcc) Emit(dr datechan.DateIdxRange) []float32 {
+	nan := float32(math.NaN())
+	res := a.obs.Emit(dr)
+	var normals []float32
+	if a.config.Normals.Daily {
+		normals = a.norm.Emit(dr)
+	} else {
+		normals = a.config.Normals.period(ymdKey(a.config.Calendar.YItoYMD(dr.Resample(dr.End)), a.offset))
+	}
+	for idx, v := range res {
+		switch {
+		case idx >= len(normals) || normals[idx] != normals[idx]:
+			res[idx] = nan
+		case !a.pct:
+			res[idx] = v - normals[idx]
+		case normals[idx] == 0:
+			res[idx] = nan
+		default:
+			res[idx] = 100 * v / normals[idx]
+		}
+	}
+	return res
+}
+
+func (a *anomalyAcc) Reset() {
+	a.obs.Reset()
+	a.norm.Reset()
+}
+
+// Anomaly returns the departure from normal ("anom_") or percent of
+// normal ("pnorm_") of the mean or sum of each grid cell over each date
+// range, against config.Normals in config.Calendar. Cells without a
+// normal are NaN, as are percents of a zero normal. Missing values are
+// handled as by the mean or sum.
+func Anomaly(ctx context.Context,
+	config Config,
+	drc datechan.DateRangeChannel,
+	inData, outData chan griddata.DataChunk) error {
+
+	if config.Normals == nil {
+		close(outData)
+		return fmt.Errorf("anomaly reduction needs normals")
+	}
+	return Accumulate(ctx, config, newAnomalyAcc(config), drc, inData, outData)
+}
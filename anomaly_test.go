@@ -0,0 +1,99 @@
+package reduce
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
+)
+
+func TestAnomalyLeapDay(t *testing.T) {
+	assert := assert.New(t)
+	cal := &datechan.Gregorian{}
+	ctx := context.Background()
+	nan := float32(math.NaN())
+
+	dates := [][]int{{2000, 2, 27}, {2000, 2, 28}, {2000, 2, 29}, {2000, 3, 1}}
+
+	days := [][]float32{
+		{10, 1},
+		{20, nan},
+		{30, 2},
+		{40, 3},
+	}
+	// no Feb 29 normal
+	normals := map[int][]float32{
+		0: {5, 1},
+		1: {10, 1},
+		3: {20, 1},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		daily    bool
+		expected []float32
+	}{
+		{"anom_mean", true, []float32{12.5, 1}},
+		{"pnorm_sum", true, []float32{200, 200}},
+		{"anom_mean", false, []float32{5, -18}},
+	} {
+		var elem params.Element
+		jsonBlob := []byte(`{"vX":4, "interval":[0,0,4], "duration":4, "reduce":"` + tc.name + `","maxMissing":1}`)
+		err := json.Unmarshal(jsonBlob, &elem)
+		assert.Nil(err)
+		cfg, err := Setup(elem)
+		assert.Nil(err)
+
+		cfg.Normals = &Normals{Daily: tc.daily}
+		normData := make(chan griddata.DataChunk, 10)
+		for day, data := range normals {
+			if !tc.daily {
+				// one normal for the range ending Mar 1
+				if day != 3 {
+					continue
+				}
+				data = []float32{20, 20}
+			}
+			normData <- griddata.DataChunk{Date: cal.YMDtoYI(dates[day]), Data: data}
+		}
+		close(normData)
+		assert.Nil(cfg.Normals.Load(ctx, cal, normData))
+
+		drCfg := datechan.IDconfig{
+			Interval:      elem.DateIterConfig.Interval,
+			Duration:      elem.DateIterConfig.Duration,
+			Sdate:         []int{2000, 3, 1},
+			Edate:         []int{2000, 3, 1},
+			Calendar:      cal,
+			InResolution:  3,
+			OutResolution: 3,
+		}
+		drCfg.Validate()
+		drc := datechan.New(ctx, drCfg)
+
+		inData := make(chan griddata.DataChunk, 10)
+		outData := make(chan griddata.DataChunk, 0)
+		for day, data := range days {
+			inData <- griddata.DataChunk{
+				Date: cal.YMDtoYI(dates[day]),
+				Data: data,
+			}
+		}
+		close(inData)
+		go func() {
+			err := cfg.Func(ctx, cfg, drc, inData, outData)
+			assert.Nil(err)
+		}()
+
+		d, ok := <-outData
+		assert.True(ok)
+		assert.Equal(tc.expected, d.Data, tc.name)
+		_, ok = <-outData
+		assert.False(ok)
+	}
+}
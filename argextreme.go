@@ -0,0 +1,27 @@
+package reduce
+
+import "gitlab.com/bnoon/datechan"
+
+func init() {
+	Register("argmin", "offset of the minimum from the start of the range", AccumulatorFactory(newArgExtremeAcc))
+	Register("argmax", "offset of the maximum from the start of the range", AccumulatorFactory(newArgExtremeAcc))
+}
+
+// argExtremeAcc is extremeAcc returning the offset of the extreme from
+// the start of the range, the earliest if it occurs more than once, with
+// the extreme itself as companion.
+type argExtremeAcc struct {
+	*extremeAcc
+}
+
+func newArgExtremeAcc(config Config) Accumulator {
+	return argExtremeAcc{newExtremeAcc(config)}
+}
+
+func (a argExtremeAcc) Emit(dr datechan.DateIdxRange) []float32 {
+	return a.emit(dr, func(e extremeEntry) float32 { return offsetIn(dr, e.date) })
+}
+
+func (a argExtremeAcc) EmitCompanion(dr datechan.DateIdxRange) []float32 {
+	return a.extremeAcc.Emit(dr)
+}
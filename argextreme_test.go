@@ -0,0 +1,82 @@
+package reduce
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
+)
+
+func TestArgMaxCompanion(t *testing.T) {
+	assert := assert.New(t)
+	cal := &datechan.Gregorian{}
+	ctx := context.Background()
+
+	var elem params.Element
+	jsonBlob := []byte(`{"vX":4, "interval":[0,0,4], "duration":4, "reduce":"argmax","maxMissing":1}`)
+	err := json.Unmarshal(jsonBlob, &elem)
+	assert.Nil(err)
+	nan := float32(math.NaN())
+	cfg, err := Setup(elem)
+	assert.Nil(err)
+	cfg.Companion = make(chan griddata.DataChunk, 1)
+
+	drCfg := datechan.IDconfig{
+		Interval:      elem.DateIterConfig.Interval,
+		Duration:      elem.DateIterConfig.Duration,
+		Sdate:         []int{2000, 1, 4},
+		Edate:         []int{2000, 1, 4},
+		Calendar:      cal,
+		InResolution:  3,
+		OutResolution: 3,
+	}
+	drCfg.Validate()
+	drc := datechan.New(ctx, drCfg)
+
+	inData := make(chan griddata.DataChunk, 10)
+	outData := make(chan griddata.DataChunk, 0)
+
+	inData <- griddata.DataChunk{
+		Date: cal.YMDtoYI([]int{2000, 1, 1}),
+		Data: []float32{3, nan, nan, 1},
+	}
+	inData <- griddata.DataChunk{
+		Date: cal.YMDtoYI([]int{2000, 1, 2}),
+		Data: []float32{5, 2, nan, 1},
+	}
+	inData <- griddata.DataChunk{
+		Date: cal.YMDtoYI([]int{2000, 1, 3}),
+		Data: []float32{2, 5, 1, 1},
+	}
+	inData <- griddata.DataChunk{
+		Date: cal.YMDtoYI([]int{2000, 1, 4}),
+		Data: []float32{5, 3, 0, 1},
+	}
+	close(inData)
+	go func() {
+		err := cfg.Func(ctx, cfg, drc, inData, outData)
+		assert.Nil(err)
+	}()
+	d, ok := <-outData
+	assert.True(ok)
+	assert.Equal([]float32{1, 2}, d.Data[:2])
+	assert.False(d.Data[2] == d.Data[2])
+	assert.Equal(float32(0), d.Data[3])
+
+	v, ok := <-cfg.Companion
+	assert.True(ok)
+	assert.Equal(d.Date, v.Date)
+	assert.Equal([]float32{5, 5}, v.Data[:2])
+	assert.False(v.Data[2] == v.Data[2])
+	assert.Equal(float32(1), v.Data[3])
+
+	_, ok = <-outData
+	assert.False(ok)
+	_, ok = <-cfg.Companion
+	assert.False(ok)
+}
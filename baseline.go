@@ -0,0 +1,425 @@
+package reduce
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
+)
+
+var (
+	baseline_pattern   *regexp.Regexp = regexp.MustCompile(`^(cnt|pct|fct|sum)_(lt|gt|le|ge)_p(\d*\.?\d*)$`)
+	base_spell_pattern *regexp.Regexp = regexp.MustCompile(`^spell_(lt|gt|le|ge)_p(\d*\.?\d*)_(\d+)$`)
+)
+
+func init() {
+	RegisterPattern(baseline_pattern,
+		"number, percentage, fraction or sum of values beyond a percentile of Config.Baseline, e.g. pct_gt_p90 (TX90p) or sum_gt_p95 (R95p)",
+		func(elem params.Element) (Config, error) {
+			cfg, _ := funcFactory(BaseThreshold)(elem)
+			cfg.NewAccumulator = func(c Config) Accumulator { return newBaseAcc(c) }
+			cfg.Needs = "Baseline"
+			m := baseline_pattern.FindStringSubmatch(elem.ReduceDef)
+			pVal, err := strconv.ParseFloat(m[3], 32)
+			if err != nil || pVal < 0 || pVal > 100 {
+				return cfg, fmt.Errorf("invalid percentile")
+			}
+			cfg.ThresholdType = m[1]
+			cfg.Threshold = m[2]
+			cfg.Percentile = float32(pVal)
+			return cfg, nil
+		})
+	RegisterPattern(base_spell_pattern,
+		"days in runs of at least n values beyond a percentile of Config.Baseline, e.g. spell_gt_p90_6 (WSDI)",
+		func(elem params.Element) (Config, error) {
+			cfg, _ := funcFactory(BaseSpell)(elem)
+			cfg.NewAccumulator = newBaseSpellAcc
+			cfg.Needs = "Baseline"
+			m := base_spell_pattern.FindStringSubmatch(elem.ReduceDef)
+			pVal, err := strconv.ParseFloat(m[2], 32)
+			if err != nil || pVal < 0 || pVal > 100 {
+				return cfg, fmt.Errorf("invalid percentile")
+			}
+			minRun, err := strconv.Atoi(m[3])
+			if err != nil || minRun < 1 {
+				return cfg, fmt.Errorf("invalid run length")
+			}
+			cfg.ThresholdType = "spell"
+			cfg.Threshold = m[1]
+			cfg.Percentile = float32(pVal)
+			cfg.MinRun = minRun
+			return cfg, nil
+		})
+}
+
+// baseDay is a chunk of the base period.
+type baseDay struct {
+	ymd  []int
+	data []float32
+}
+
+// thresholdKey identifies the thresholds of a calendar day and offset
+// for a percentile.
+type thresholdKey struct {
+	normalKey
+	p float32
+}
+
+// Baseline holds the daily values of a base period, e.g. 1961-1990, from
+// which the percentile reductions take a threshold per cell and calendar
+// day, see Load.
+//
+// The sample of a calendar day is the values of the Window days centered
+// on it, in all years. Thresholds are interpolated by quantile8. Feb 29
+// is only part of the samples of its neighbors, and uses the thresholds
+// of Feb 28.
+//
+// Days of a year in the base period are compared to the thresholds of
+// the ETCCDI bootstrap: for each other base year, the thresholds of the
+// base period with the year replaced by that other year. The result is
+// the mean over the other years.
+//
+// With WetDay not 0 there is instead one sample per cell, the values of
+// at least WetDay of all days, e.g. 1 mm for R95p, and no bootstrap.
+//
+// A loaded Baseline may be shared by concurrent reductions.
+type Baseline struct {
+	// Window is the number of days of each sample, 5 if 0.
+	Window int
+	WetDay float32
+
+	// samples holds the chunks of each sample by year.
+	samples map[normalKey]map[int][][]float32
+	years   []int
+
+	// mu guards thresholds, the cache of the thresholds without
+	// bootstrap.
+	mu         sync.Mutex
+	thresholds map[thresholdKey][]float32
+}
+
+// key returns the calendar day and offset of the thresholds of date.
+func (b *Baseline) key(ymd []int, offset int) normalKey {
+	if b.WetDay != 0 {
+		return normalKey{offset: offset}
+	}
+	k := ymdKey(ymd, offset)
+	if k.month == 2 && k.day == 29 {
+		k.day = 28
+	}
+	return k
+}
+
+// Load reads the daily chunks of the base period, dated in cal, from in
+// until it is closed. The chunks of each offset must be
+// consecutive days.
+func (b *Baseline) Load(ctx context.Context, cal datechan.Calendar, in chan griddata.DataChunk) error {
+	if cal == nil {
+		return fmt.Errorf("baseline needs a calendar")
+	}
+	days := make(map[int][]baseDay)
+loadLoop:
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case dc, ok := <-in:
+			if !ok {
+				break loadLoop
+			}
+			days[dc.Offset] = append(days[dc.Offset], baseDay{ymd: cal.YItoYMD(dc.Date), data: dc.Data})
+		}
+	}
+
+	half := b.Window / 2
+	if b.Window == 0 {
+		half = 2
+	}
+	b.samples = make(map[normalKey]map[int][][]float32)
+	b.thresholds = make(map[thresholdKey][]float32)
+	inBase := make(map[int]bool)
+	for offset, seq := range days {
+		for j, d := range seq {
+			inBase[d.ymd[0]] = true
+			if b.WetDay == 0 && len(d.ymd) > 2 && d.ymd[1] == 2 && d.ymd[2] == 29 {
+				continue
+			}
+			k := b.key(d.ymd, offset)
+			if b.samples[k] == nil {
+				b.samples[k] = make(map[int][][]float32)
+			}
+			lo, hi := j-half, j+half
+			if b.WetDay != 0 {
+				lo, hi = j, j
+			}
+			for w := lo; w <= hi; w++ {
+				if w >= 0 && w < len(seq) {
+					b.samples[k][d.ymd[0]] = append(b.samples[k][d.ymd[0]], seq[w].data)
+				}
+			}
+		}
+	}
+	b.years = b.years[:0]
+	for y := range inBase {
+		b.years = append(b.years, y)
+	}
+	sort.Ints(b.years)
+	return nil
+}
+
+// threshold returns the p-th percentile of the sample of k with the
+// values of year skip replaced by those of year dup, nil if there is no
+// sample. Cells with no value in the sample are NaN.
+func (b *Baseline) threshold(k normalKey, p float32, skip, dup int) []float32 {
+	tk := thresholdKey{k, p}
+	if skip == dup {
+		b.mu.Lock()
+		t, ok := b.thresholds[tk]
+		b.mu.Unlock()
+		if ok {
+			return t
+		}
+	}
+
+	var chunks [][]float32
+	for y, c := range b.samples[k] {
+		if y != skip || skip == dup {
+			chunks = append(chunks, c...)
+		}
+	}
+	if skip != dup {
+		chunks = append(chunks, b.samples[k][dup]...)
+	}
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	nan := float32(math.NaN())
+	t := make([]float32, len(chunks[0]))
+	vals := make([]float32, 0, len(chunks))
+	for idx := range t {
+		vals = vals[:0]
+		for _, c := range chunks {
+			if v := c[idx]; v == v && (b.WetDay == 0 || v >= b.WetDay) {
+				vals = append(vals, v)
+			}
+		}
+		if len(vals) == 0 {
+			t[idx] = nan
+			continue
+		}
+		sort.Sort(float32s(vals))
+		t[idx] = quantile8(vals, p)
+	}
+	if skip == dup {
+		b.mu.Lock()
+		b.thresholds[tk] = t
+		b.mu.Unlock()
+	}
+	return t
+}
+
+// baseContrib is the part of a chunk in the counts of baseAcc.
+type baseContrib struct {
+	exc   []float32
+	valid []bool
+}
+
+// baseAcc keeps the counts of the percentile reductions, like
+// thresholdAcc, and the contribution of each chunk so that removing it
+// needs no second bootstrap.
+type baseAcc struct {
+	config  Config
+	beyond  func(v, t float32) bool
+	pCnt    []float32
+	cnt     []int
+	contrib map[string]baseContrib
+}
+
+func newBaseAcc(config Config) *baseAcc {
+	return &baseAcc{config: config, beyond: beyondFunc(config.Threshold)}
+}
+
+// beyondFunc returns the comparison of a value to its threshold for op.
+func beyondFunc(op string) func(v, t float32) bool {
+	switch op {
+	case "lt":
+		return func(v, t float32) bool { return v < t }
+	case "gt":
+		return func(v, t float32) bool { return v > t }
+	case "le":
+		return func(v, t float32) bool { return v <= t }
+	}
+	return func(v, t float32) bool { return v >= t }
+}
+
+// count returns the contribution of dc, bootstrapped for base years.
+func (a *baseAcc) count(dc griddata.DataChunk) baseContrib {
+	b := a.config.Baseline
+	ymd := a.config.Calendar.YItoYMD(dc.Date)
+	k := b.key(ymd, dc.Offset)
+
+	year := 0
+	if b.WetDay == 0 {
+		year = ymd[0]
+	}
+	others := []int{year}
+	if i := sort.SearchInts(b.years, year); i < len(b.years) && b.years[i] == year {
+		others = make([]int, 0, len(b.years)-1)
+		for _, y := range b.years {
+			if y != year {
+				others = append(others, y)
+			}
+		}
+	}
+
+	c := baseContrib{
+		exc:   make([]float32, len(dc.Data)),
+		valid: make([]bool, len(dc.Data))}
+	for _, dup := range others {
+		t := b.threshold(k, a.config.Percentile, year, dup)
+		for idx, v := range dc.Data {
+			if v != v || idx >= len(t) || t[idx] != t[idx] {
+				continue
+			}
+			c.valid[idx] = true
+			if a.beyond(v, t[idx]) {
+				if a.config.ThresholdType == "sum" {
+					c.exc[idx] += v
+				} else {
+					c.exc[idx]++
+				}
+			}
+		}
+	}
+	for idx := range c.exc {
+		c.exc[idx] /= float32(len(others))
+	}
+	return c
+}
+
+func (a *baseAcc) Add(dr datechan.DateIdxRange, dc griddata.DataChunk) {
+	if a.pCnt == nil {
+		a.pCnt = make([]float32, len(dc.Data))
+		a.cnt = make([]int, len(dc.Data))
+		a.contrib = make(map[string]baseContrib)
+	}
+	c := a.count(dc)
+	a.contrib[dc.Date.Key()] = c
+	for idx, v := range c.exc {
+		a.pCnt[idx] += v
+		if c.valid[idx] {
+			a.cnt[idx]++
+		}
+	}
+}
+
+func (a *baseAcc) Remove(dc griddata.DataChunk) {
+	c := a.contrib[dc.Date.Key()]
+	delete(a.contrib, dc.Date.Key())
+	for idx, v := range c.exc {
+		a.pCnt[idx] -= v
+		if c.valid[idx] {
+			a.cnt[idx]--
+		}
+	}
+}
+
+func (a *baseAcc) Emit(dr datechan.DateIdxRange) []float32 {
+	return thresholdResult(a.config, a.pCnt, a.cnt, dr.Len())
+}
+
+func (a *baseAcc) Reset() {
+	a.pCnt = nil
+	a.cnt = nil
+	a.contrib = nil
+}
+
+// BaseThreshold counts, for "cnt_", "pct_" and "fct_", or sums, for
+// "sum_", the values of each grid cell beyond the config.Percentile
+// percentile of config.Baseline for their day, in config.Calendar, over
+// each date range. Cells without a threshold count as
+// missing.
+func BaseThreshold(ctx context.Context,
+	config Config,
+	drc datechan.DateRangeChannel,
+	inData, outData chan griddata.DataChunk) error {
+
+	if err := checkNeeds(config); err != nil {
+		close(outData)
+		return err
+	}
+	return Accumulate(ctx, config, newBaseAcc(config), drc, inData, outData)
+}
+
+// baseSpellAcc keeps the run states of values beyond the thresholds of
+// the baseline and the offset of the last observation, like spellAcc.
+// The thresholds are those of the whole base period, without bootstrap.
+type baseSpellAcc struct {
+	config Config
+	beyond func(v, t float32) bool
+	runs   []runState
+	cnt    []int
+	last   float32
+}
+
+func newBaseSpellAcc(config Config) Accumulator {
+	return &baseSpellAcc{config: config, beyond: beyondFunc(config.Threshold)}
+}
+
+func (a *baseSpellAcc) Add(dr datechan.DateIdxRange, dc griddata.DataChunk) {
+	off := offsetIn(dr, dc.Date)
+	if a.runs == nil {
+		a.runs = make([]runState, len(dc.Data))
+		a.cnt = make([]int, len(dc.Data))
+	} else if off > a.last+1 {
+		for idx := range a.runs {
+			a.runs[idx].add(false, a.config.MinRun)
+		}
+	}
+	a.last = off
+	b := a.config.Baseline
+	ymd := a.config.Calendar.YItoYMD(dc.Date)
+	t := b.threshold(b.key(ymd, dc.Offset), a.config.Percentile, ymd[0], ymd[0])
+	for idx, v := range dc.Data {
+		if v != v || idx >= len(t) || t[idx] != t[idx] {
+			a.runs[idx].add(false, a.config.MinRun)
+			continue
+		}
+		a.cnt[idx]++
+		a.runs[idx].add(a.beyond(v, t[idx]), a.config.MinRun)
+	}
+}
+
+func (a *baseSpellAcc) Emit(dr datechan.DateIdxRange) []float32 {
+	return runResult(a.config, a.runs, a.cnt, dr.Len())
+}
+
+func (a *baseSpellAcc) Reset() {
+	a.runs = nil
+	a.cnt = nil
+}
+
+// BaseSpell returns the number of values of each grid cell in runs of at
+// least config.MinRun values beyond the config.Percentile percentile of
+// config.Baseline for their day, over each date range, e.g. the warm
+// spell duration index. A missing value or a date absent from the input
+// ends the current run.
+func BaseSpell(ctx context.Context,
+	config Config,
+	drc datechan.DateRangeChannel,
+	inData, outData chan griddata.DataChunk) error {
+
+	if err := checkNeeds(config); err != nil {
+		close(outData)
+		return err
+	}
+	return Accumulate(ctx, config, newBaseSpellAcc(config), drc, inData, outData)
+}
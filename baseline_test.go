@@ -0,0 +1,126 @@
+package reduce
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
+)
+
+func TestQuantile8(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(float32(20), quantile8([]float32{10, 20, 30}, 50))
+	assert.Equal(float32(10), quantile8([]float32{5, 15}, 50))
+	assert.Equal(float32(5), quantile8([]float32{5, 15}, 10))
+	assert.Equal(float32(15), quantile8([]float32{5, 15}, 90))
+}
+
+func TestBaseThreshold(t *testing.T) {
+	assert := assert.New(t)
+	cal := &datechan.Gregorian{}
+	ctx := context.Background()
+	nan := float32(math.NaN())
+
+	// Jan 1 of the base years
+	base := map[int][]float32{
+		2000: {10, 5},
+		2001: {20, nan},
+		2002: {30, 15},
+	}
+
+	for _, tc := range []struct {
+		year     int
+		data     []float32
+		expected []float32
+	}{
+		// thresholds 20 and 10
+		{2010, []float32{25, 12}, []float32{1, 1}},
+		// bootstrap thresholds 10 and 30 for 2000 and 2002 in place of 2001
+		{2001, []float32{20, nan}, []float32{0.5, nan}},
+	} {
+		var elem params.Element
+		jsonBlob := []byte(`{"vX":4, "interval":[0,0,1], "duration":1, "reduce":"cnt_gt_p50"}`)
+		err := json.Unmarshal(jsonBlob, &elem)
+		assert.Nil(err)
+		cfg, err := Setup(elem)
+		assert.Nil(err)
+
+		cfg.Baseline = &Baseline{Window: 1}
+		baseData := make(chan griddata.DataChunk, 10)
+		for y := 2000; y <= 2002; y++ {
+			baseData <- griddata.DataChunk{Date: cal.YMDtoYI([]int{y, 1, 1}), Data: base[y]}
+		}
+		close(baseData)
+		assert.Nil(cfg.Baseline.Load(ctx, cal, baseData))
+
+		drCfg := datechan.IDconfig{
+			Interval:      elem.DateIterConfig.Interval,
+			Duration:      elem.DateIterConfig.Duration,
+			Sdate:         []int{tc.year, 1, 1},
+			Edate:         []int{tc.year, 1, 1},
+			Calendar:      cal,
+			InResolution:  3,
+			OutResolution: 3,
+		}
+		drCfg.Validate()
+		drc := datechan.New(ctx, drCfg)
+
+		inData := make(chan griddata.DataChunk, 10)
+		outData := make(chan griddata.DataChunk, 0)
+		inData <- griddata.DataChunk{Date: cal.YMDtoYI([]int{tc.year, 1, 1}), Data: tc.data}
+		close(inData)
+		go func() {
+			err := cfg.Func(ctx, cfg, drc, inData, outData)
+			assert.Nil(err)
+		}()
+
+		d, ok := <-outData
+		assert.True(ok)
+		for idx, v := range tc.expected {
+			if v != v {
+				assert.True(d.Data[idx] != d.Data[idx], tc.year)
+			} else {
+				assert.Equal(v, d.Data[idx], tc.year)
+			}
+		}
+		_, ok = <-outData
+		assert.False(ok)
+	}
+
+	_, err := Setup(params.Element{ReduceDef: "pct_gt_p101"})
+	assert.NotNil(err)
+}
+
+func TestBaselineShared(t *testing.T) {
+	assert := assert.New(t)
+	cal := &datechan.Gregorian{}
+	ctx := context.Background()
+
+	baseData := make(chan griddata.DataChunk, 10)
+	for y := 2000; y <= 2002; y++ {
+		d := []int{y, 1, 1}
+		baseData <- griddata.DataChunk{Date: cal.YMDtoYI(d), Data: []float32{float32(10 * (y - 1999))}}
+	}
+	close(baseData)
+	b := &Baseline{Window: 1}
+	assert.Nil(b.Load(ctx, cal, baseData))
+
+	// reductions sharing the baseline fill its cache concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			k := b.key([]int{2010, 1, 1}, 0)
+			assert.Equal([]float32{20}, b.threshold(k, 50, 2010, 2010))
+		}()
+	}
+	wg.Wait()
+}
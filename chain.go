@@ -0,0 +1,160 @@
+package reduce
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
+)
+
+// Stage is one reduction of a Chain with the date iteration of its
+// element.
+type Stage struct {
+	Config
+	Dates params.DateIterConfig
+	// OutResolution is the resolution of the output of the stage, and
+	// the input of the next: 1 for years, 2 for months, 3 for days.
+	// SetupChain takes it from the length of the interval.
+	OutResolution int
+}
+
+// Chain is a sequence of reductions, the output chunks of each stage
+// feeding the next, e.g. the mean over years of annual maximums or the
+// number of months with a total below a threshold. Each stage has its
+// own date iteration and MaxMissing.
+type Chain []Stage
+
+// SetupChain returns the Chain of the reductions of elems, in order.
+func SetupChain(elems []params.Element) (Chain, error) {
+	if len(elems) == 0 {
+		return nil, fmt.Errorf("empty chain")
+	}
+	c := make(Chain, len(elems))
+	for i, elem := range elems {
+		cfg, err := Setup(elem)
+		if err != nil {
+			return nil, fmt.Errorf("stage %d: %v", i, err)
+		}
+		c[i] = Stage{
+			Config:        cfg,
+			Dates:         elem.DateIterConfig,
+			OutResolution: len(elem.DateIterConfig.Interval),
+		}
+	}
+	return c, nil
+}
+
+// ParseChain returns the Chain of a JSON array of elements, e.g.
+//
+//	[{"interval":[1], "duration":1, "reduce":"max"},
+//	 {"interval":[30], "duration":1, "reduce":"mean", "maxMissing":3}]
+func ParseChain(data []byte) (Chain, error) {
+	var elems []params.Element
+	if err := json.Unmarshal(data, &elems); err != nil {
+		return nil, err
+	}
+	return SetupChain(elems)
+}
+
+// Run runs the stages of c concurrently, reading inData and writing the
+// output of the last stage to outData, which it closes on return. The
+// last stage iterates over the date ranges of its element ending from
+// period.Sdate to period.Edate, each stage before it over its ranges
+// ending from the start of the first range of the stage after, up to
+// period.Edate. The dates are taken to the OutResolution of each stage,
+// in period.Calendar, which is also the Calendar of the stages. The
+// first stage reads period.InResolution, the later stages the
+// OutResolution of the stage before. Ranges of a stage that start
+// before the output of the stage before count its absent dates as
+// missing.
+//
+// Run returns when all stages are done. The first error of any stage
+// cancels the others and is returned.
+func (c Chain) Run(ctx context.Context,
+	period datechan.IDconfig,
+	inData, outData chan griddata.DataChunk) error {
+
+	if len(c) == 0 {
+		close(outData)
+		return fmt.Errorf("empty chain")
+	}
+	if period.Calendar == nil {
+		close(outData)
+		return fmt.Errorf("chain needs a calendar")
+	}
+
+	drCfgs := make([]datechan.IDconfig, len(c))
+	sdate := period.Sdate
+	for i := len(c) - 1; i >= 0; i-- {
+		stage := c[i]
+		drCfg := period
+		drCfg.Interval = stage.Dates.Interval
+		drCfg.Duration = stage.Dates.Duration
+		drCfg.Sdate = toResolution(sdate, stage.OutResolution)
+		drCfg.Edate = toResolution(period.Edate, stage.OutResolution)
+		drCfg.OutResolution = stage.OutResolution
+		if i > 0 {
+			drCfg.InResolution = c[i-1].OutResolution
+		}
+		if err := drCfg.Validate(); err != nil {
+			close(outData)
+			return fmt.Errorf("stage %d: %v", i, err)
+		}
+		drCfgs[i] = drCfg
+
+		start, ok := firstStart(ctx, drCfg)
+		if !ok {
+			close(outData)
+			return fmt.Errorf("stage %d: no date ranges", i)
+		}
+		sdate = period.Calendar.YItoYMD(start)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errc := make(chan error, len(c))
+	in := inData
+	for i, stage := range c {
+		out := outData
+		if i < len(c)-1 {
+			out = make(chan griddata.DataChunk)
+		}
+		cfg := stage.Config
+		cfg.Calendar = period.Calendar
+		go func(cfg Config, drc datechan.DateRangeChannel, in, out chan griddata.DataChunk) {
+			errc <- cfg.Func(ctx, cfg, drc, in, out)
+		}(cfg, datechan.New(ctx, drCfgs[i]), in, out)
+		in = out
+	}
+
+	var err error
+	for range c {
+		if e := <-errc; e != nil && err == nil {
+			err = e
+			cancel()
+		}
+	}
+	return err
+}
+
+// firstStart returns the start of the first date range of drCfg, false
+// if there is none.
+func firstStart(ctx context.Context, drCfg datechan.IDconfig) (datechan.DateIdx, bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	dr, ok := <-datechan.New(ctx, drCfg)
+	return dr.Start, ok
+}
+
+// toResolution returns the year, month and day of ymd as far as
+// resolution res goes.
+func toResolution(ymd []int, res int) []int {
+	if res > 0 && len(ymd) > res {
+		return ymd[:res]
+	}
+	return ymd
+}
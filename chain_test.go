@@ -0,0 +1,110 @@
+package reduce
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
+)
+
+// runChain runs the chain of chainJSON over daily data from January 1,
+// 2000 to edate, of value(day) for each day, and returns the data of the
+// output chunks.
+func runChain(t *testing.T, chainJSON string, sdate, edate []int, value func(day time.Time) []float32) [][]float32 {
+	assert := assert.New(t)
+	cal := &datechan.Gregorian{}
+	ctx := context.Background()
+
+	chain, err := ParseChain([]byte(chainJSON))
+	assert.Nil(err)
+
+	inData := make(chan griddata.DataChunk, 10)
+	outData := make(chan griddata.DataChunk, 0)
+	go func() {
+		end := time.Date(edate[0], time.Month(edate[1]), edate[2], 0, 0, 0, 0, time.UTC)
+		for day := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC); !day.After(end); day = day.AddDate(0, 0, 1) {
+			inData <- griddata.DataChunk{
+				Date: cal.YMDtoYI([]int{day.Year(), int(day.Month()), day.Day()}),
+				Data: value(day),
+			}
+		}
+		close(inData)
+	}()
+	go func() {
+		err := chain.Run(ctx, datechan.IDconfig{
+			Sdate:        sdate,
+			Edate:        edate,
+			Calendar:     cal,
+			InResolution: 3,
+		}, inData, outData)
+		assert.Nil(err)
+	}()
+
+	var res [][]float32
+	for d := range outData {
+		res = append(res, d.Data)
+	}
+	return res
+}
+
+func TestChainMeanOfAnnualMax(t *testing.T) {
+	nan := float32(math.NaN())
+
+	// 1 but for one day a year, 10, 20 and 30 in the first cell and 5,
+	// 10 and 15 in the second, which misses 2001
+	peak := map[int][]float32{2000: {10, 5}, 2001: {20, nan}, 2002: {30, 15}}
+	value := func(day time.Time) []float32 {
+		data := []float32{1, 1}
+		if day.Year() == 2001 {
+			data[1] = nan
+		}
+		if day.YearDay() == 100 {
+			copy(data, peak[day.Year()])
+		}
+		return data
+	}
+
+	chain := `[
+		{"vX":4, "interval":[1], "duration":1, "reduce":"max"},
+		{"vX":4, "interval":[3], "duration":1, "reduce":"mean", "maxMissing":1}]`
+	res := runChain(t, chain, []int{2002, 12, 31}, []int{2002, 12, 31}, value)
+	if assert.Len(t, res, 1) {
+		assertData(t, []float32{20, 10}, res[0], "mean of annual max")
+	}
+
+	c, err := ParseChain([]byte(chain))
+	assert.Nil(t, err)
+	if assert.Len(t, c, 2) {
+		assert.Equal(t, 1, c[0].OutResolution)
+		assert.Equal(t, params.DateIterConfig{Interval: []int{3}, Duration: 1}, c[1].Dates)
+	}
+
+	_, err = ParseChain([]byte(`[{"reduce":"mean"}, {"reduce":"bogus"}]`))
+	assert.NotNil(t, err)
+}
+
+func TestChainCountOfMonthlySums(t *testing.T) {
+	// daily precipitation of 1 in the first cell, and in the second from
+	// July on; months with less than 31 in 2000 are February, April,
+	// June, September and November in the first, January to June,
+	// September and November in the second
+	value := func(day time.Time) []float32 {
+		if day.Month() < time.July {
+			return []float32{1, 0}
+		}
+		return []float32{1, 1}
+	}
+
+	res := runChain(t, `[
+		{"vX":4, "interval":[0,1], "duration":1, "reduce":"sum"},
+		{"vX":4, "interval":[1], "duration":1, "reduce":"cnt_lt_31"}]`,
+		[]int{2000, 12, 31}, []int{2000, 12, 31}, value)
+	if assert.Len(t, res, 1) {
+		assertData(t, []float32{5, 8}, res[0], "months below 31")
+	}
+}
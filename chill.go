@@ -0,0 +1,247 @@
+package reduce
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
+)
+
+var chill_pattern *regexp.Regexp = regexp.MustCompile(`^chill_(hours|utah|portions)$`)
+
+func init() {
+	RegisterPattern(chill_pattern,
+		"chill accumulation of hourly temperatures in °F, or of daily tmin and tmax: hours from 32 to 45 °F, Utah chill units or dynamic model chill portions, e.g. chill_utah",
+		func(elem params.Element) (Config, error) {
+			cfg, _ := funcFactory(Chill)(elem)
+			cfg.NewAccumulator = newChillAcc
+			cfg.Vars = 2
+			m := chill_pattern.FindStringSubmatch(elem.ReduceDef)
+			cfg.ThresholdType = m[1]
+			return cfg, nil
+		})
+}
+
+// utahUnits returns the Utah chill units (Richardson et al., 1974) of an
+// hour at t °F.
+func utahUnits(t float32) float32 {
+	switch {
+	case t <= 34:
+		return 0
+	case t <= 36:
+		return 0.5
+	case t <= 48:
+		return 1
+	case t <= 54:
+		return 0.5
+	case t <= 60:
+		return 0
+	case t <= 65:
+		return -0.5
+	}
+	return -1
+}
+
+// Constants of the dynamic model (Fishman et al., 1987), as in chillR.
+const (
+	dynE0     = 4153.5
+	dynE1     = 12888.8
+	dynA0     = 139500
+	dynA1     = 2.567e18
+	dynSlope  = 1.6
+	dynTetmlt = 277
+)
+
+// dynamicState is the intermediate product of the dynamic model of one
+// grid cell, and its fraction xi of the previous hour.
+type dynamicState struct {
+	inter, xi float64
+}
+
+// add returns the chill portions of an hour at t °F.
+func (s *dynamicState) add(t float32) float32 {
+	tk := (float64(t)-32)*5/9 + 273
+	sr := math.Exp(dynSlope * dynTetmlt * (tk - dynTetmlt) / tk)
+	xi := sr / (1 + sr)
+	xs := dynA0 / dynA1 * math.Exp((dynE1-dynE0)/tk)
+	ak1 := dynA1 * math.Exp(-dynE1/tk)
+
+	start := s.inter
+	if start >= 1 {
+		start *= 1 - s.xi
+	}
+	s.inter = xs - (xs-start)*math.Exp(-ak1)
+	s.xi = xi
+	if s.inter < 1 {
+		return 0
+	}
+	return float32(s.inter * xi)
+}
+
+// dailyHours interpolates the hourly temperatures of a day from its
+// minimum, at 6:00, and maximum, at 15:00, by half cosine waves: rising
+// from the minimum to the maximum, falling after 15:00 toward the
+// minimum and, before 6:00, from prevMax, the maximum of the previous
+// day if it is valid, to the minimum.
+func dailyHours(prevMax, tmin, tmax float32) [24]float32 {
+	if prevMax != prevMax {
+		prevMax = tmax
+	}
+	var hours [24]float32
+	for h := range hours {
+		var from, to, frac float64
+		switch {
+		case h < 6:
+			from, to, frac = float64(prevMax), float64(tmin), float64(h+9)/15
+		case h <= 15:
+			from, to, frac = float64(tmin), float64(tmax), float64(h-6)/9
+		default:
+			from, to, frac = float64(tmax), float64(tmin), float64(h-15)/15
+		}
+		hours[h] = float32(from + (to-from)*(1-math.Cos(math.Pi*frac))/2)
+	}
+	return hours
+}
+
+// chillAcc accumulates the chill of each grid cell by the model of
+// ThresholdType, from daily or hourly chunks by the resolution of their
+// dates, see Check. The dynamic model carries state from hour to hour, so the
+// driver rebuilds it for overlapping ranges.
+type chillAcc struct {
+	config  Config
+	daily   bool
+	chill   []float32
+	cnt     []int
+	dyn     []dynamicState
+	prevMax []float32
+}
+
+func newChillAcc(config Config) Accumulator {
+	return &chillAcc{config: config}
+}
+
+// hourly reports whether the resolution of date is finer than days.
+func hourly(date datechan.DateIdx) bool {
+	return date.Y > 3
+}
+
+// Check rejects chunks without one variable per hour or two, the
+// minimum and maximum, per day.
+func (a *chillAcc) Check(dc griddata.DataChunk) error {
+	vars := 2
+	if hourly(dc.Date) {
+		vars = 1
+	}
+	if len(dc.Data)%vars != 0 || (dc.Length > 0 && len(dc.Data) != vars*dc.Length) {
+		return fmt.Errorf("chill needs %d variables at %s", vars, dc.Date.Key())
+	}
+	return nil
+}
+
+// hour adds an hour at t °F to cell idx.
+func (a *chillAcc) hour(idx int, t float32) {
+	switch a.config.ThresholdType {
+	case "hours":
+		if t >= 32 && t <= 45 {
+			a.chill[idx]++
+		}
+	case "utah":
+		a.chill[idx] += utahUnits(t)
+	case "portions":
+		a.chill[idx] += a.dyn[idx].add(t)
+	}
+}
+
+func (a *chillAcc) Add(dr datechan.DateIdxRange, dc griddata.DataChunk) {
+	if a.chill == nil {
+		a.daily = !hourly(dc.Date)
+	}
+	n := len(dc.Data)
+	if a.daily {
+		n /= 2
+	}
+	if a.chill == nil {
+		nan := float32(math.NaN())
+		a.chill = make([]float32, n)
+		a.cnt = make([]int, n)
+		a.dyn = make([]dynamicState, n)
+		a.prevMax = make([]float32, n)
+		for idx := range a.prevMax {
+			a.prevMax[idx] = nan
+		}
+	}
+	if !a.daily {
+		for idx, v := range dc.Data {
+			if v == v {
+				a.cnt[idx]++
+				a.hour(idx, v)
+			}
+		}
+		return
+	}
+	for idx := 0; idx < n; idx++ {
+		tmin, tmax := dc.Data[idx], dc.Data[n+idx]
+		prevMax := a.prevMax[idx]
+		a.prevMax[idx] = tmax
+		if tmin != tmin || tmax != tmax {
+			continue
+		}
+		a.cnt[idx]++
+		for _, t := range dailyHours(prevMax, tmin, tmax) {
+			a.hour(idx, t)
+		}
+	}
+}
+
+func (a *chillAcc) Emit(dr datechan.DateIdxRange) []float32 {
+	nan := float32(math.NaN())
+	expCnt := dr.Len()
+	if a.chill != nil {
+		switch hourlyRange := hourly(dr.End); {
+		case a.daily && hourlyRange:
+			expCnt /= 24
+		case !a.daily && !hourlyRange:
+			expCnt *= 24
+		}
+	}
+	res := make([]float32, len(a.chill))
+	for idx, v := range a.chill {
+		if expCnt-a.cnt[idx] > a.config.MaxMissing {
+			res[idx] = nan
+		} else {
+			res[idx] = v
+		}
+	}
+	return res
+}
+
+func (a *chillAcc) Reset() {
+	a.chill = nil
+	a.cnt = nil
+	a.dyn = nil
+	a.prevMax = nil
+}
+
+// Chill returns the chill accumulated by each grid cell over each date
+// range, of temperatures in °F, by the model of config.ThresholdType:
+// the hours from 32 to 45 °F ("chill_hours"), Utah chill units
+// ("chill_utah") or dynamic model chill portions ("chill_portions").
+//
+// The input is one chunk per hour or, when the dates of the chunks have
+// a daily resolution, per day with the daily minimum and maximum, whose
+// hours are interpolated by dailyHours. Daily input is two variables,
+// run by RunMulti with config.Vars 2, hourly input one, read by Chill
+// directly. Chunks with other numbers of values are an error. Missing
+// hours or days count toward MaxMissing, against the length of the range
+// in units of the input.
+func Chill(ctx context.Context,
+	config Config,
+	drc datechan.DateRangeChannel,
+	inData, outData chan griddata.DataChunk) error {
+
+	return Accumulate(ctx, config, newChillAcc(config), drc, inData, outData)
+}
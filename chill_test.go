@@ -0,0 +1,168 @@
+package reduce
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
+)
+
+func TestChillModels(t *testing.T) {
+	assert := assert.New(t)
+	cal := &datechan.Gregorian{}
+	nan := float32(math.NaN())
+
+	for temp, units := range map[float32]float32{
+		30: 0, 35: 0.5, 40: 1, 50: 0.5, 58: 0, 62: -0.5, 70: -1,
+	} {
+		assert.Equal(units, utahUnits(temp), temp)
+	}
+
+	hours := dailyHours(nan, 30, 50)
+	assert.Equal(float32(30), hours[6])
+	assert.Equal(float32(50), hours[15])
+	for h := 7; h <= 15; h++ {
+		assert.True(hours[h] > hours[h-1], h)
+	}
+	assert.True(hours[23] < hours[16])
+
+	// 10 days at 6 °C, and of a daily cycle from -2 to 14 °C, against
+	// the chill portions of the Dynamic_Model of chillR
+	var cold, cycle, warm dynamicState
+	var coldSum, cycleSum, warmSum float32
+	for h := 0; h < 240; h++ {
+		coldSum += cold.add(42.8)
+		cycleSum += cycle.add(float32(42.8 + 14.4*math.Sin(2*math.Pi*float64(h)/24)))
+		warmSum += warm.add(77)
+	}
+	assert.InDelta(7.8207457, coldSum, 1e-3)
+	assert.InDelta(5.5980092, cycleSum, 1e-3)
+	assert.Equal(float32(0), warmSum)
+
+	// hourly input over a day, 19 hours absent
+	day := datechan.DateIdxRange{Start: cal.YMDtoYI([]int{2000, 1, 1}), End: cal.YMDtoYI([]int{2000, 1, 1})}
+	for maxMissing, expected := range map[int]float32{19: 3, 18: nan} {
+		cfg, err := Setup(params.Element{ReduceDef: "chill_hours", MaxMissing: maxMissing})
+		assert.Nil(err)
+		acc := cfg.NewAccumulator(cfg)
+		for h, temp := range []float32{31, 32, 40, 45, 46, nan} {
+			acc.Add(day, griddata.DataChunk{Date: cal.YMDtoYI([]int{2000, 1, 1, h}), Data: []float32{temp}})
+		}
+		assertData(t, []float32{expected}, acc.Emit(day), "hourly")
+	}
+
+	// daily input over 48 hours, one day absent
+	twoDays := datechan.DateIdxRange{Start: cal.YMDtoYI([]int{2000, 1, 1, 0}), End: cal.YMDtoYI([]int{2000, 1, 2, 23})}
+	for maxMissing, expected := range map[int]float32{1: 24, 0: nan} {
+		cfg, err := Setup(params.Element{ReduceDef: "chill_hours", MaxMissing: maxMissing})
+		assert.Nil(err)
+		acc := cfg.NewAccumulator(cfg)
+		acc.Add(twoDays, griddata.DataChunk{Date: cal.YMDtoYI([]int{2000, 1, 1}), Data: []float32{40, 40}})
+		assertData(t, []float32{expected}, acc.Emit(twoDays), "daily")
+	}
+}
+
+func TestChillDaily(t *testing.T) {
+	assert := assert.New(t)
+	cal := &datechan.Gregorian{}
+	ctx := context.Background()
+
+	tmin := [][]float32{{40, 70}, {40, 70}}
+	tmax := [][]float32{{40, 70}, {40, 70}}
+
+	for name, expected := range map[string][]float32{
+		"chill_hours": {48, 0},
+		"chill_utah":  {48, -48},
+	} {
+		var elem params.Element
+		jsonBlob := []byte(`{"vX":4, "interval":[0,0,2], "duration":2, "reduce":"` + name + `"}`)
+		err := json.Unmarshal(jsonBlob, &elem)
+		assert.Nil(err)
+		cfg, err := Setup(elem)
+		assert.Nil(err)
+		assert.Equal(2, cfg.Vars)
+
+		drCfg := datechan.IDconfig{
+			Interval:      elem.DateIterConfig.Interval,
+			Duration:      elem.DateIterConfig.Duration,
+			Sdate:         []int{2000, 1, 2},
+			Edate:         []int{2000, 1, 2},
+			Calendar:      cal,
+			InResolution:  3,
+			OutResolution: 3,
+		}
+		drCfg.Validate()
+		drc := datechan.New(ctx, drCfg)
+
+		inputs := []chan griddata.DataChunk{
+			make(chan griddata.DataChunk, 10),
+			make(chan griddata.DataChunk, 10),
+		}
+		outData := make(chan griddata.DataChunk, 0)
+		for day := range tmin {
+			d := []int{2000, 1, day + 1}
+			date := cal.YMDtoYI(d)
+			inputs[0] <- griddata.DataChunk{Date: date, Length: 2, Data: tmin[day]}
+			inputs[1] <- griddata.DataChunk{Date: date, Length: 2, Data: tmax[day]}
+		}
+		close(inputs[0])
+		close(inputs[1])
+		go func() {
+			err := RunMulti(ctx, cfg, drc, inputs, outData)
+			assert.Nil(err)
+		}()
+
+		d, ok := <-outData
+		assert.True(ok)
+		assert.Equal(expected, d.Data, name)
+		_, ok = <-outData
+		assert.False(ok)
+	}
+}
+
+func TestChillVariables(t *testing.T) {
+	assert := assert.New(t)
+	cal := &datechan.Gregorian{}
+	ctx := context.Background()
+
+	cfg, err := Setup(params.Element{ReduceDef: "chill_hours"})
+	assert.Nil(err)
+	acc := cfg.NewAccumulator(cfg).(Checker)
+	assert.Nil(acc.Check(griddata.DataChunk{Date: cal.YMDtoYI([]int{2000, 1, 1, 0}), Length: 2, Data: []float32{40, 40}}))
+	assert.NotNil(acc.Check(griddata.DataChunk{Date: cal.YMDtoYI([]int{2000, 1, 1, 0}), Length: 1, Data: []float32{40, 40}}))
+	assert.NotNil(acc.Check(griddata.DataChunk{Date: cal.YMDtoYI([]int{2000, 1, 1}), Data: []float32{40}}))
+
+	// a daily stream of one variable, not split into two cells of tmin
+	// and tmax
+	drCfg := datechan.IDconfig{
+		Interval:      []int{0, 0, 2},
+		Duration:      2,
+		Sdate:         []int{2000, 1, 2},
+		Edate:         []int{2000, 1, 2},
+		Calendar:      cal,
+		InResolution:  3,
+		OutResolution: 3,
+	}
+	drCfg.Validate()
+	drc := datechan.New(ctx, drCfg)
+
+	inData := make(chan griddata.DataChunk, 10)
+	outData := make(chan griddata.DataChunk, 0)
+	for day := 1; day <= 2; day++ {
+		inData <- griddata.DataChunk{Date: cal.YMDtoYI([]int{2000, 1, day}), Length: 2, Data: []float32{40, 50}}
+	}
+	close(inData)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- cfg.Func(ctx, cfg, drc, inData, outData)
+	}()
+	for range outData {
+		assert.Fail("unexpected output")
+	}
+	assert.NotNil(<-errc)
+}
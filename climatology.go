@@ -0,0 +1,191 @@
+package reduce
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
+)
+
+var climatology_pattern *regexp.Regexp = regexp.MustCompile(`^clim(\d*)_(.+)$`)
+
+func init() {
+	RegisterPattern(climatology_pattern,
+		"mean across years of a reduction of each position in the year, e.g. clim_mean or clim_cnt_gt_90; clim<n>_ allows n missing years, e.g. clim5_mean",
+		func(elem params.Element) (Config, error) {
+			m := climatology_pattern.FindStringSubmatch(elem.ReduceDef)
+			inner := elem
+			inner.ReduceDef = m[2]
+			cfg, err := Setup(inner)
+			if err != nil {
+				return cfg, err
+			}
+			if cfg.NewAccumulator == nil {
+				return cfg, fmt.Errorf("no climatology of %s", m[2])
+			}
+			if m[1] != "" {
+				years, err := strconv.Atoi(m[1])
+				if err != nil {
+					return cfg, fmt.Errorf("invalid missing years")
+				}
+				cfg.MaxMissingYears = years
+			}
+			cfg.Func = Climatology
+			return cfg, nil
+		})
+}
+
+// climPosition is the state of one position in the year: the sum of
+// the valid results of its ranges, their number and that of the ranges.
+type climPosition struct {
+	key   normalKey
+	date  datechan.DateIdx
+	sum   []float32
+	valid []int
+	years int
+}
+
+// Climatology reduces each date range of drc with the inner reduction
+// of config.NewAccumulator, with config.Name the name of the inner
+// reduction, e.g. "mean" for "clim_mean", and averages the results of
+// each position in the year across years, e.g. the normal monthly
+// means of a run of years from monthly ranges. The position of a range
+// is the month and day of its output date, in config.Calendar. The
+// ranges of drc are in order and may overlap.
+//
+// MaxMissing applies within each range, as for the inner reduction, and
+// a cell is NaN when more than MaxMissingYears of the ranges of its
+// position are missing. Once inData is closed one chunk is written per
+// position, in order of month and day, dated by its last range.
+func Climatology(ctx context.Context,
+	config Config,
+	drc datechan.DateRangeChannel,
+	inData, outData chan griddata.DataChunk) error {
+
+	defer close(outData)
+	if config.NewAccumulator == nil {
+		return fmt.Errorf("climatology needs an accumulator")
+	}
+	if err := checkNeeds(config); err != nil {
+		return err
+	}
+
+	var ranges []datechan.DateIdxRange
+rangeLoop:
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case dr, ok := <-drc:
+			if !ok {
+				break rangeLoop
+			}
+			ranges = append(ranges, dr)
+		}
+	}
+
+	inner := config
+	inner.Companion = nil
+
+	positions := make(map[normalKey]*climPosition)
+	finish := func(dr datechan.DateIdxRange, acc Accumulator) {
+		date := dr.Resample(dr.End)
+		k := ymdKey(config.Calendar.YItoYMD(date), 0)
+		p, ok := positions[k]
+		if !ok {
+			p = &climPosition{key: k}
+			positions[k] = p
+		}
+		p.date = date
+		p.years++
+		if acc == nil {
+			return
+		}
+		data := acc.Emit(dr)
+		if p.sum == nil {
+			p.sum = make([]float32, len(data))
+			p.valid = make([]int, len(data))
+		}
+		for idx, v := range data {
+			if v == v && idx < len(p.sum) {
+				p.sum[idx] += v
+				p.valid[idx]++
+			}
+		}
+	}
+
+	accs := make([]Accumulator, len(ranges))
+	var last griddata.DataChunk
+	first := 0
+dataLoop:
+	for {
+		var inDC griddata.DataChunk
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case dc, ok := <-inData:
+			if !ok {
+				break dataLoop
+			}
+			inDC = dc
+		}
+
+		for first < len(ranges) && ranges[first].End.Less(inDC.Date) {
+			finish(ranges[first], accs[first])
+			accs[first] = nil
+			first++
+		}
+		for i := first; i < len(ranges) && !inDC.Date.Less(ranges[i].Start); i++ {
+			if accs[i] == nil {
+				accs[i] = config.NewAccumulator(inner)
+			}
+			accs[i].Add(ranges[i], inDC)
+			last = inDC
+		}
+	}
+	for ; first < len(ranges); first++ {
+		finish(ranges[first], accs[first])
+	}
+
+	sorted := make([]*climPosition, 0, len(positions))
+	for _, p := range positions {
+		sorted = append(sorted, p)
+	}
+	sort.Slice(sorted, func(a, b int) bool {
+		ka, kb := sorted[a].key, sorted[b].key
+		if ka.month != kb.month {
+			return ka.month < kb.month
+		}
+		return ka.day < kb.day
+	})
+
+	nan := float32(math.NaN())
+	for _, p := range sorted {
+		data := make([]float32, len(last.Data))
+		for idx := range data {
+			if idx >= len(p.sum) || p.valid[idx] == 0 ||
+				p.years-p.valid[idx] > config.MaxMissingYears {
+				data[idx] = nan
+			} else {
+				data[idx] = p.sum[idx] / float32(p.valid[idx])
+			}
+		}
+		outDC := griddata.DataChunk{
+			Date:   p.date,
+			Offset: last.Offset,
+			Length: last.Length,
+			Data:   data}
+		select {
+		case outData <- outDC:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package reduce
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
+)
+
+func TestClimatology(t *testing.T) {
+	assert := assert.New(t)
+	cal := &datechan.Gregorian{}
+	ctx := context.Background()
+	nan := float32(math.NaN())
+
+	// January and February of 2000-2002, 1, 11 and 21 in each year. The
+	// second cell is missing 2 days of January 2001 and the third
+	// January 2000 and 2001.
+	var days []griddata.DataChunk
+	for y := 2000; y <= 2002; y++ {
+		v := float32(1 + 10*(y-2000))
+		for day := time.Date(y, 1, 1, 0, 0, 0, 0, time.UTC); day.Month() <= 2; day = day.AddDate(0, 0, 1) {
+			data := []float32{v, v, v}
+			if day.Month() == 1 && y < 2002 {
+				data[2] = nan
+			}
+			if y == 2001 && day.Month() == 1 && day.Day() <= 2 {
+				data[1] = nan
+			}
+			d := []int{y, int(day.Month()), day.Day()}
+			days = append(days, griddata.DataChunk{Date: cal.YMDtoYI(d), Data: data})
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		years    int
+		expected [][]float32
+	}{
+		{"clim1_mean", 1, [][]float32{{11, 11, nan}, {11, 11, 11}}},
+		{"clim_mean", 0, [][]float32{{11, nan, nan}, {11, 11, 11}}},
+		{"clim2_mean", 2, [][]float32{{11, 11, 21}, {11, 11, 11}}},
+		{"clim_cnt_gt_5", 0, [][]float32{{62. / 3, nan, nan}, {56. / 3, 56. / 3, 56. / 3}}},
+		{"clim_sum", 0, [][]float32{{341, nan, nan}, {925. / 3, 925. / 3, 925. / 3}}},
+	} {
+		var elem params.Element
+		jsonBlob := []byte(`{"vX":4, "interval":[0,1], "duration":1, "reduce":"` + tc.name + `","maxMissing":1}`)
+		err := json.Unmarshal(jsonBlob, &elem)
+		assert.Nil(err)
+		cfg, err := Setup(elem)
+		assert.Nil(err, tc.name)
+		assert.Equal(tc.years, cfg.MaxMissingYears, tc.name)
+
+		// monthly ranges of January 2000 to February 2002
+		drCfg := datechan.IDconfig{
+			Interval:      elem.DateIterConfig.Interval,
+			Duration:      elem.DateIterConfig.Duration,
+			Sdate:         []int{2000, 1},
+			Edate:         []int{2002, 2},
+			Calendar:      cal,
+			InResolution:  3,
+			OutResolution: 2,
+		}
+		drCfg.Validate()
+		drc := datechan.New(ctx, drCfg)
+
+		inData := make(chan griddata.DataChunk, len(days))
+		outData := make(chan griddata.DataChunk, 0)
+		for _, dc := range days {
+			inData <- dc
+		}
+		close(inData)
+		go func() {
+			err := cfg.Func(ctx, cfg, drc, inData, outData)
+			assert.Nil(err)
+		}()
+
+		var res []griddata.DataChunk
+		for d := range outData {
+			res = append(res, d)
+		}
+		// one position per month, March to December without data
+		if !assert.Len(res, 12, tc.name) {
+			continue
+		}
+		for m, d := range res {
+			if m < len(tc.expected) {
+				assert.Equal(cal.YMDtoYI([]int{2002, m + 1}), d.Date, tc.name)
+				assertData(t, tc.expected[m], d.Data, tc.name)
+			} else {
+				assertData(t, []float32{nan, nan, nan}, d.Data, tc.name)
+			}
+		}
+	}
+
+	_, err := Setup(params.Element{ReduceDef: "clim_bogus"})
+	assert.NotNil(err)
+
+	// percentile reductions without a baseline
+	for _, name := range []string{"clim_pct_gt_p90", "clim_TX90p"} {
+		cfg, err := Setup(params.Element{ReduceDef: name})
+		assert.Nil(err, name)
+		drc := make(datechan.DateRangeChannel)
+		inData := make(chan griddata.DataChunk)
+		outData := make(chan griddata.DataChunk)
+		close(drc)
+		close(inData)
+		assert.NotNil(cfg.Func(ctx, cfg, drc, inData, outData), name)
+		_, ok := <-outData
+		assert.False(ok, name)
+	}
+}
@@ -0,0 +1,97 @@
+package reduce
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"gitlab.com/bnoon/griddata/params"
+)
+
+var (
+	degreeday_pattern  *regexp.Regexp = regexp.MustCompile(`^(gdd|hdd|cdd)_([-+]?\d*\.?\d*)(?:_([-+]?\d*\.?\d*))?$`)
+	exceedance_pattern *regexp.Regexp = regexp.MustCompile(`^exc_(lt|gt|le|ge|eq|ne)_([-+]?\d*\.?\d*)$`)
+)
+
+func init() {
+	RegisterPattern(degreeday_pattern,
+		"growing, heating or cooling degree days, e.g. gdd_50, gdd_50_86 or hdd_65",
+		func(elem params.Element) (Config, error) {
+			cfg, _ := AccumulatorFactory(newDegreeDayAcc)(elem)
+			m := degreeday_pattern.FindStringSubmatch(elem.ReduceDef)
+			base, err := strconv.ParseFloat(m[2], 32)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid base temperature")
+			}
+			cfg.ThresholdType = m[1]
+			cfg.ThresholdValue = float32(base)
+			if m[3] != "" {
+				upper, err := strconv.ParseFloat(m[3], 32)
+				if err != nil || m[1] != "gdd" || upper <= base {
+					return cfg, fmt.Errorf("invalid upper temperature")
+				}
+				cfg.ThresholdUpper = float32(upper)
+			}
+			return cfg, nil
+		})
+	RegisterPattern(exceedance_pattern,
+		"sum of the amount by which values pass a threshold, e.g. exc_gt_95",
+		func(elem params.Element) (Config, error) {
+			cfg, _ := AccumulatorFactory(newDegreeDayAcc)(elem)
+			m := exceedance_pattern.FindStringSubmatch(elem.ReduceDef)
+			if m[1] == "eq" || m[1] == "ne" {
+				return cfg, fmt.Errorf("invalid exceedance")
+			}
+			tVal, err := strconv.ParseFloat(m[2], 32)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid threshold")
+			}
+			cfg.ThresholdType = "exc"
+			cfg.Threshold = m[1]
+			cfg.ThresholdValue = float32(tVal)
+			return cfg, nil
+		})
+}
+
+// newDegreeDayAcc returns a sumAcc of the degree days of config:
+// max(v-base, 0) for gdd and cdd, max(base-v, 0) for hdd, with values
+// above ThresholdUpper counted as ThresholdUpper for capped gdd. The
+// exceedances are max(v-t, 0) above and max(t-v, 0) below t.
+func newDegreeDayAcc(config Config) Accumulator {
+	return &sumAcc{config: config, fn: degreeDayFunc(config)}
+}
+
+// degreeDayFunc returns the daily degree day, or exceedance, function of
+// config.
+func degreeDayFunc(config Config) func(float32) float32 {
+	base, upper := config.ThresholdValue, config.ThresholdUpper
+	below := config.ThresholdType == "hdd" ||
+		(config.ThresholdType == "exc" && (config.Threshold == "lt" || config.Threshold == "le"))
+	switch {
+	case below:
+		return func(v float32) float32 {
+			if v < base {
+				return base - v
+			}
+			return 0
+		}
+	case config.ThresholdType == "gdd":
+		if upper > base {
+			return func(v float32) float32 {
+				if v > upper {
+					v = upper
+				}
+				if v > base {
+					return v - base
+				}
+				return 0
+			}
+		}
+	}
+	return func(v float32) float32 {
+		if v > base {
+			return v - base
+		}
+		return 0
+	}
+}
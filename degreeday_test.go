@@ -0,0 +1,59 @@
+package reduce
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDegreeDays(t *testing.T) {
+	days := [][]float32{{40}, {60}, {90}, {70}}
+
+	for reduce, exp := range map[string]float32{
+		"gdd_50":    70,
+		"gdd_50_86": 66,
+		"hdd_65":    30,
+		"cdd_65":    30,
+	} {
+		res := runDaily(t, `{"vX":4, "interval":[0,0,4], "duration":4, "reduce":"`+reduce+`"}`,
+			[]int{2000, 1, 4}, []int{2000, 1, 4}, days)
+		if assert.Len(t, res, 1, reduce) {
+			assertData(t, []float32{exp}, res[0], reduce)
+		}
+	}
+
+	// two day windows ending January 2, 3 and 4
+	for reduce, exp := range map[string][]float32{
+		"gdd_50":    {10, 50, 60},
+		"gdd_50_86": {10, 46, 56},
+		"hdd_65":    {30, 5, 0},
+		"cdd_65":    {0, 25, 30},
+	} {
+		res := runDaily(t, `{"vX":4, "interval":[0,0,1], "duration":2, "reduce":"`+reduce+`"}`,
+			[]int{2000, 1, 2}, []int{2000, 1, 4}, days)
+		if assert.Len(t, res, len(exp), reduce) {
+			for i := range exp {
+				assertData(t, exp[i:i+1], res[i], reduce)
+			}
+		}
+	}
+}
+
+func TestExceedanceOverlap(t *testing.T) {
+	days := [][]float32{{1}, {0.2}, {0}, {3}, {0.5}}
+
+	// three day windows ending January 3, 4 and 5, each dropping the
+	// exceedance of the day leaving the window
+	for reduce, exp := range map[string][]float32{
+		"exc_gt_0.5": {0.5, 2.5, 2.5},
+		"exc_lt_0.5": {0.8, 0.8, 0.5},
+	} {
+		res := runDaily(t, `{"vX":4, "interval":[0,0,1], "duration":3, "reduce":"`+reduce+`"}`,
+			[]int{2000, 1, 3}, []int{2000, 1, 5}, days)
+		if assert.Len(t, res, len(exp), reduce) {
+			for i := range exp {
+				assertData(t, exp[i:i+1], res[i], reduce)
+			}
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package reduce
+
+import (
+	"context"
+	"math"
+	"regexp"
+
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
+)
+
+// etccdiIndex is an ETCCDI climate extremes index, computed by the
+// reduction named reduce from daily values in °C or mm.
+type etccdiIndex struct {
+	name, reduce, desc string
+	// needs names the Config field the index needs, if any.
+	needs string
+}
+
+var etccdiIndices = []etccdiIndex{
+	{"FD", "cnt_lt_0", "frost days, TN < 0 °C", ""},
+	{"SU", "cnt_gt_25", "summer days, TX > 25 °C", ""},
+	{"ID", "cnt_lt_0", "icing days, TX < 0 °C", ""},
+	{"TR", "cnt_gt_20", "tropical nights, TN > 20 °C", ""},
+	{"GSL", "gsl", "growing season length of TG", ""},
+	{"TXx", "max", "maximum of TX", ""},
+	{"TNx", "max", "maximum of TN", ""},
+	{"TXn", "min", "minimum of TX", ""},
+	{"TNn", "min", "minimum of TN", ""},
+	{"TN10p", "pct_lt_p10", "percentage of days with TN below its 10th percentile", "Baseline"},
+	{"TX10p", "pct_lt_p10", "percentage of days with TX below its 10th percentile", "Baseline"},
+	{"TN90p", "pct_gt_p90", "percentage of days with TN above its 90th percentile", "Baseline"},
+	{"TX90p", "pct_gt_p90", "percentage of days with TX above its 90th percentile", "Baseline"},
+	{"WSDI", "spell_gt_p90_6", "warm spell duration index, days in runs of 6 or more days with TX above its 90th percentile", "Baseline"},
+	{"CSDI", "spell_lt_p10_6", "cold spell duration index, days in runs of 6 or more days with TN below its 10th percentile", "Baseline"},
+	{"DTR", "mean(v1 - v2)", "mean diurnal temperature range, of the inputs TX and TN", ""},
+	{"Rx1day", "max", "maximum 1-day precipitation", ""},
+	{"Rx5day", "maxsum_5", "maximum consecutive 5-day precipitation", ""},
+	{"SDII", "mean(v where v >= 1)", "simple daily intensity index, mean precipitation of wet days (RR >= 1 mm)", ""},
+	{"R10mm", "cnt_ge_10", "days with RR >= 10 mm", ""},
+	{"R20mm", "cnt_ge_20", "days with RR >= 20 mm", ""},
+	{"CDD", "run_lt_1", "consecutive dry days, longest run of RR < 1 mm", ""},
+	{"CWD", "run_ge_1", "consecutive wet days, longest run of RR >= 1 mm", ""},
+	{"R95pTOT", "sum_gt_p95", "precipitation of days above the 95th percentile of wet days, with Baseline.WetDay 1", "Baseline.WetDay"},
+	{"R99pTOT", "sum_gt_p99", "precipitation of days above the 99th percentile of wet days, with Baseline.WetDay 1", "Baseline.WetDay"},
+	{"PRCPTOT", "sum(v where v >= 1)", "total precipitation of wet days", ""},
+}
+
+var rnnmm_pattern *regexp.Regexp = regexp.MustCompile(`^R(\d+)mm$`)
+
+func init() {
+	for _, index := range etccdiIndices {
+		Register(index.name, "ETCCDI "+index.desc, etccdiFactory(index))
+	}
+	RegisterPattern(rnnmm_pattern,
+		"ETCCDI Rnnmm, days with RR >= nn mm, e.g. R25mm",
+		func(elem params.Element) (Config, error) {
+			m := rnnmm_pattern.FindStringSubmatch(elem.ReduceDef)
+			return etccdiFactory(etccdiIndex{name: m[0], reduce: "cnt_ge_" + m[1]})(elem)
+		})
+}
+
+// etccdiFactory returns a Factory for index, which applies the missing
+// data rules of ETCCDI in place of MaxMissing, see etccdiAcc.
+func etccdiFactory(index etccdiIndex) Factory {
+	return func(elem params.Element) (Config, error) {
+		inner := elem
+		inner.ReduceDef = index.reduce
+		cfg, err := Setup(inner)
+		if err != nil {
+			return cfg, err
+		}
+		if index.needs != "" {
+			cfg.Needs = index.needs
+		}
+		newAcc := cfg.NewAccumulator
+		cfg.NewAccumulator = func(config Config) Accumulator {
+			return newEtccdiAcc(config, newAcc)
+		}
+		cfg.Func = func(ctx context.Context,
+			config Config,
+			drc datechan.DateRangeChannel,
+			inData, outData chan griddata.DataChunk) error {
+
+			if err := checkNeeds(config); err != nil {
+				close(outData)
+				return err
+			}
+			return Accumulate(ctx, config, config.NewAccumulator(config), drc, inData, outData)
+		}
+		return cfg, nil
+	}
+}
+
+const (
+	// etccdiMonthMissing is the number of missing days allowed in a
+	// month.
+	etccdiMonthMissing = 3
+	// etccdiYearMissing is the number of missing days allowed in a year.
+	etccdiYearMissing = 15
+)
+
+// etccdiAcc applies the missing data rules of ETCCDI to the result of an
+// inner accumulator. A monthly value is missing with more than 3 missing
+// days, an annual one with more than 15 missing days or any month with
+// more than 3 missing days. Ranges of more
+// than 31 days are annual.
+//
+// Missing days include the dates absent from the input. Those of a gap
+// count toward the month of the chunk after it, back to its first day,
+// and the rest toward the month of the chunk before, the month before
+// for a gap at the start of the range. Days after the last chunk count
+// toward its month. Only a gap over a whole month misplaces days, and
+// that month is missing either way.
+type etccdiAcc struct {
+	config    Config
+	inner     Accumulator
+	valid     []int
+	monthly   map[int][]int
+	last      float32
+	lastMonth int
+}
+
+func newEtccdiAcc(config Config, newAcc func(Config) Accumulator) *etccdiAcc {
+	inner := config
+	inner.MaxMissing = math.MaxInt32
+	return &etccdiAcc{config: config, inner: newAcc(inner)}
+}
+
+func (a *etccdiAcc) Add(dr datechan.DateIdxRange, dc griddata.DataChunk) {
+	a.inner.Add(dr, dc)
+	vars := a.config.Vars
+	if vars < 1 {
+		vars = 1
+	}
+	n := len(dc.Data) / vars
+	if a.valid == nil {
+		a.valid = make([]int, n)
+		a.monthly = make(map[int][]int)
+	}
+	var missing []int
+	if ymd := a.config.Calendar.YItoYMD(dc.Date); len(ymd) > 2 {
+		off := offsetIn(dr, dc.Date)
+		gap := int(off - a.last - 1)
+		if a.lastMonth == 0 {
+			gap = int(off)
+		}
+		if gap > 0 {
+			in := gap
+			if in > ymd[2]-1 {
+				in = ymd[2] - 1
+			}
+			prev := a.lastMonth
+			if prev == 0 {
+				prev = (ymd[1]+10)%12 + 1
+			}
+			a.absent(ymd[1], in, n)
+			a.absent(prev, gap-in, n)
+		}
+		a.last, a.lastMonth = off, ymd[1]
+		missing = a.month(ymd[1], n)
+	}
+	for idx := 0; idx < n; idx++ {
+		ok := true
+		for k := 0; k < vars; k++ {
+			if v := dc.Data[k*n+idx]; v != v {
+				ok = false
+			}
+		}
+		if ok {
+			a.valid[idx]++
+		} else if missing != nil {
+			missing[idx]++
+		}
+	}
+}
+
+// month returns the missing day counts of month, for n cells.
+func (a *etccdiAcc) month(month, n int) []int {
+	if a.monthly[month] == nil {
+		a.monthly[month] = make([]int, n)
+	}
+	return a.monthly[month]
+}
+
+// absent counts days absent from the input toward month, for n cells.
+func (a *etccdiAcc) absent(month, days, n int) {
+	if days <= 0 {
+		return
+	}
+	missing := a.month(month, n)
+	for idx := range missing {
+		missing[idx] += days
+	}
+}
+
+func (a *etccdiAcc) Emit(dr datechan.DateIdxRange) []float32 {
+	nan := float32(math.NaN())
+	res := a.inner.Emit(dr)
+	expCnt := dr.Len()
+	annual := expCnt > 31
+	limit := etccdiMonthMissing
+	if annual {
+		limit = etccdiYearMissing
+	}
+	tail := 0
+	if a.lastMonth != 0 {
+		tail = expCnt - 1 - int(a.last)
+	}
+	for idx := range res {
+		if idx >= len(a.valid) || expCnt-a.valid[idx] > limit {
+			res[idx] = nan
+			continue
+		}
+		if annual {
+			for month, missing := range a.monthly {
+				m := missing[idx]
+				if month == a.lastMonth {
+					m += tail
+				}
+				if m > etccdiMonthMissing {
+					res[idx] = nan
+				}
+			}
+		}
+	}
+	return res
+}
+
+func (a *etccdiAcc) Reset() {
+	a.inner.Reset()
+	a.valid = nil
+	a.monthly = nil
+	a.lastMonth = 0
+}
@@ -0,0 +1,172 @@
+package reduce
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
+)
+
+func TestETCCDI(t *testing.T) {
+	assert := assert.New(t)
+	cal := &datechan.Gregorian{}
+	ctx := context.Background()
+	nan := float32(math.NaN())
+
+	// -10 °C from November to March, 10 °C otherwise; cell 1 misses
+	// Jan 1-4, cell 2 the 15th of each month
+	var days []griddata.DataChunk
+	for day := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC); day.Year() == 2000; day = day.AddDate(0, 0, 1) {
+		d := []int{day.Year(), int(day.Month()), day.Day()}
+		v := float32(10)
+		if d[1] <= 3 || d[1] >= 11 {
+			v = -10
+		}
+		data := []float32{v, v, v}
+		if d[1] == 1 && d[2] <= 4 {
+			data[1] = nan
+		}
+		if d[2] == 15 {
+			data[2] = nan
+		}
+		days = append(days, griddata.DataChunk{Date: cal.YMDtoYI(d), Data: data})
+	}
+
+	for name, expected := range map[string][]float32{
+		"FD":     {152, nan, 147},
+		"GSL":    {214, nan, 214},
+		"Rx5day": {50, nan, 50},
+	} {
+		var elem params.Element
+		jsonBlob := []byte(`{"vX":4, "interval":[1], "duration":1, "reduce":"` + name + `"}`)
+		err := json.Unmarshal(jsonBlob, &elem)
+		assert.Nil(err)
+		cfg, err := Setup(elem)
+		assert.Nil(err, name)
+
+		drCfg := datechan.IDconfig{
+			Interval:      elem.DateIterConfig.Interval,
+			Duration:      elem.DateIterConfig.Duration,
+			Sdate:         []int{2000, 12},
+			Edate:         []int{2000, 12},
+			Calendar:      cal,
+			InResolution:  3,
+			OutResolution: 3,
+		}
+		drCfg.Validate()
+		drc := datechan.New(ctx, drCfg)
+
+		inData := make(chan griddata.DataChunk, len(days))
+		outData := make(chan griddata.DataChunk, 0)
+		for _, dc := range days {
+			inData <- dc
+		}
+		close(inData)
+		go func() {
+			err := cfg.Func(ctx, cfg, drc, inData, outData)
+			assert.Nil(err)
+		}()
+
+		d, ok := <-outData
+		assert.True(ok)
+		for idx, v := range expected {
+			if v != v {
+				assert.True(d.Data[idx] != d.Data[idx], name)
+			} else {
+				assert.Equal(v, d.Data[idx], name)
+			}
+		}
+		_, ok = <-outData
+		assert.False(ok)
+	}
+
+	cfg, err := Setup(params.Element{ReduceDef: "R25mm"})
+	assert.Nil(err)
+	assert.Equal(float32(25), cfg.ThresholdValue)
+
+	cfg, err = Setup(params.Element{ReduceDef: "TX90p"})
+	assert.Nil(err)
+	outData := make(chan griddata.DataChunk)
+	assert.NotNil(cfg.Func(ctx, cfg, nil, nil, outData))
+	_, ok := <-outData
+	assert.False(ok)
+
+	// R95pTOT needs the wet day threshold of its baseline
+	cfg, err = Setup(params.Element{ReduceDef: "R95pTOT"})
+	assert.Nil(err)
+	cfg.Baseline = &Baseline{}
+	outData = make(chan griddata.DataChunk)
+	assert.NotNil(cfg.Func(ctx, cfg, nil, nil, outData))
+	_, ok = <-outData
+	assert.False(ok)
+}
+
+func TestETCCDIAbsentDays(t *testing.T) {
+	assert := assert.New(t)
+	cal := &datechan.Gregorian{}
+	ctx := context.Background()
+	nan := float32(math.NaN())
+
+	for _, tc := range []struct {
+		name     string
+		absent   func(month, day int) bool
+		expected float32
+	}{
+		{"3 days of February", func(m, d int) bool { return m == 2 && d >= 10 && d <= 12 }, 0},
+		{"4 days of February", func(m, d int) bool { return m == 2 && d >= 10 && d <= 13 }, nan},
+		{"January 31 to February 3", func(m, d int) bool { return (m == 1 && d == 31) || (m == 2 && d <= 3) }, 0},
+		{"January 1-4", func(m, d int) bool { return m == 1 && d <= 4 }, nan},
+		{"December 29-31", func(m, d int) bool { return m == 12 && d >= 29 }, 0},
+		{"December 28-31", func(m, d int) bool { return m == 12 && d >= 28 }, nan},
+	} {
+		var days []griddata.DataChunk
+		for day := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC); day.Year() == 2000; day = day.AddDate(0, 0, 1) {
+			d := []int{day.Year(), int(day.Month()), day.Day()}
+			if !tc.absent(d[1], d[2]) {
+				days = append(days, griddata.DataChunk{Date: cal.YMDtoYI(d), Data: []float32{10}})
+			}
+		}
+
+		var elem params.Element
+		err := json.Unmarshal([]byte(`{"vX":4, "interval":[1], "duration":1, "reduce":"FD"}`), &elem)
+		assert.Nil(err)
+		cfg, err := Setup(elem)
+		assert.Nil(err)
+
+		drCfg := datechan.IDconfig{
+			Interval:      elem.DateIterConfig.Interval,
+			Duration:      elem.DateIterConfig.Duration,
+			Sdate:         []int{2000, 12},
+			Edate:         []int{2000, 12},
+			Calendar:      cal,
+			InResolution:  3,
+			OutResolution: 3,
+		}
+		drCfg.Validate()
+		drc := datechan.New(ctx, drCfg)
+
+		inData := make(chan griddata.DataChunk, len(days))
+		outData := make(chan griddata.DataChunk, 0)
+		for _, dc := range days {
+			inData <- dc
+		}
+		close(inData)
+		go func() {
+			err := cfg.Func(ctx, cfg, drc, inData, outData)
+			assert.Nil(err)
+		}()
+
+		d, ok := <-outData
+		if assert.True(ok, tc.name) {
+			assertData(t, []float32{tc.expected}, d.Data, tc.name)
+		}
+		_, ok = <-outData
+		assert.False(ok)
+	}
+}
@@ -0,0 +1,464 @@
+package reduce
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
+)
+
+// exprVars maps the variables of expressions to their input, v being
+// the same as v1.
+var exprVars = map[string]int{
+	"v": 0, "v1": 0, "v2": 1, "v3": 2, "v4": 3, "v5": 4, "v6": 5, "v7": 6, "v8": 7, "v9": 8,
+}
+
+var expr_pattern *regexp.Regexp = regexp.MustCompile(`^(sum|mean|min|max|var|std|median|cnt|pct|fct)\((.+)\)$`)
+
+func init() {
+	RegisterPattern(expr_pattern,
+		"aggregate of an expression of each value v, e.g. sum(max(v - 50, 0)), cnt(v > 90 && v < 100) or mean(v1 where v2 > 0.1)",
+		func(elem params.Element) (Config, error) {
+			cfg, _ := AccumulatorFactory(newExprAcc)(elem)
+			m := expr_pattern.FindStringSubmatch(elem.ReduceDef)
+			fn, cond, nvars, err := compileWhere(m[2], exprVars)
+			if err != nil {
+				return cfg, err
+			}
+			cfg.Expr = &Expr{Agg: m[1], fn: fn, cond: cond}
+			cfg.Vars = nvars
+			return cfg, nil
+		})
+}
+
+// Expr is the compiled expression of an expression reduction such as
+// "sum(max(v - 50, 0))": an aggregator, Agg, of an expression of the
+// variables of each observation.
+//
+// Expressions are made of numbers, the variables v or v1 to v9, the
+// arithmetic operators + - * /, the comparisons < <= > >= == !=, the
+// logical operators && || !, parentheses and the functions abs, sqrt,
+// exp, log, floor, ceil, min(a, b), max(a, b) and pow(a, b).
+// Comparisons and logical operators return 1 for true and 0 for false;
+// any other value than 0 is true. Expressions are evaluated in float64.
+//
+// The aggregators are those of the same name, applied to the value of
+// the expression, except cnt, pct and fct, which count the observations
+// for which the expression is true as the threshold reductions do. An
+// expression evaluating to NaN, e.g. log of a negative value, counts as
+// a missing value.
+//
+// Expressions of more than one variable, e.g. "sum(v1 * (v2 < 32))" for
+// the precipitation v1 on days with tmax v2 below freezing, are run with
+// RunMulti, v<i> being the value of input i. An observation is missing
+// when any of its variables is.
+//
+// An expression may be followed by a condition, "<expr> where <cond>",
+// e.g. "sum(v1 where v2 > 32)" for the precipitation v1 on days with tmin
+// v2 above freezing. Only the observations meeting the condition are
+// aggregated; the others are valid but do not qualify, so they do not
+// count toward MaxMissing. The number of qualifying observations of each
+// cell is sent on Config.Companion, if set, see Accumulate.
+type Expr struct {
+	Agg  string
+	fn   exprNode
+	cond exprNode
+}
+
+// exprNode is a compiled expression, evaluated for the variables of one
+// observation.
+type exprNode func(vars []float64) float64
+
+// exprAcc feeds the values of the expression of config to the
+// accumulator of its aggregator, counting the valid and qualifying
+// observations of each cell itself. The aggregator does not check
+// MaxMissing, non-qualifying observations are not missing.
+type exprAcc struct {
+	fn, cond    exprNode
+	truth       bool
+	scale       float64
+	maxMissing  int
+	valid, qual []int
+	inner       interface {
+		Accumulator
+		Remover
+	}
+	vars []float64
+}
+
+func newExprAcc(config Config) Accumulator {
+	nvars := config.Vars
+	if nvars < 1 {
+		nvars = 1
+	}
+	a := &exprAcc{
+		fn:         config.Expr.fn,
+		cond:       config.Expr.cond,
+		scale:      1,
+		maxMissing: config.MaxMissing,
+		vars:       make([]float64, nvars)}
+	inner := config
+	inner.Name = config.Expr.Agg
+	inner.MaxMissing = math.MaxInt32
+	switch config.Expr.Agg {
+	case "sum":
+		a.inner = &sumAcc{config: inner}
+	case "mean":
+		a.inner = &meanAcc{sumAcc{config: inner}}
+	case "min", "max":
+		a.inner = newExtremeAcc(inner)
+	case "var", "std":
+		a.inner = &varianceAcc{config: inner}
+	case "median":
+		inner.Percentile = 50
+		a.inner = &percentileAcc{config: inner}
+	case "cnt":
+		a.truth = true
+		a.inner = &sumAcc{config: inner}
+	case "pct":
+		a.truth, a.scale = true, 100
+		a.inner = &meanAcc{sumAcc{config: inner}}
+	case "fct":
+		a.truth = true
+		a.inner = &meanAcc{sumAcc{config: inner}}
+	}
+	return a
+}
+
+// eval returns the chunk of expression values of dc, which holds the
+// data of each variable in turn (see Zip), NaN for the observations that
+// are missing or do not qualify. The counts of valid and qualifying
+// observations are adjusted by delta.
+func (a *exprAcc) eval(dc griddata.DataChunk, delta int) griddata.DataChunk {
+	nan := float32(math.NaN())
+	n := len(dc.Data) / len(a.vars)
+	if a.valid == nil {
+		a.valid = make([]int, n)
+		a.qual = make([]int, n)
+	}
+	data := make([]float32, n)
+cellLoop:
+	for idx := range data {
+		data[idx] = nan
+		for k := range a.vars {
+			v := dc.Data[k*n+idx]
+			if v != v {
+				continue cellLoop
+			}
+			a.vars[k] = float64(v)
+		}
+		if a.cond != nil && a.cond(a.vars) == 0 {
+			a.valid[idx] += delta
+			continue
+		}
+		r := a.fn(a.vars)
+		if r != r {
+			continue
+		}
+		if a.truth {
+			r = b2f(r != 0) * a.scale
+		}
+		data[idx] = float32(r)
+		a.valid[idx] += delta
+		a.qual[idx] += delta
+	}
+	dc.Data = data
+	return dc
+}
+
+func (a *exprAcc) Add(dr datechan.DateIdxRange, dc griddata.DataChunk) {
+	a.inner.Add(dr, a.eval(dc, 1))
+}
+
+func (a *exprAcc) Remove(dc griddata.DataChunk) {
+	a.inner.Remove(a.eval(dc, -1))
+}
+
+// mask sets the cells of res missing more than MaxMissing values to NaN.
+func (a *exprAcc) mask(dr datechan.DateIdxRange, res []float32) []float32 {
+	nan := float32(math.NaN())
+	expCnt := dr.Len()
+	for idx := range res {
+		if expCnt-a.valid[idx] > a.maxMissing {
+			res[idx] = nan
+		}
+	}
+	return res
+}
+
+func (a *exprAcc) Emit(dr datechan.DateIdxRange) []float32 {
+	return a.mask(dr, a.inner.Emit(dr))
+}
+
+// EmitCompanion returns the number of qualifying observations.
+func (a *exprAcc) EmitCompanion(dr datechan.DateIdxRange) []float32 {
+	res := make([]float32, len(a.qual))
+	for idx, v := range a.qual {
+		res[idx] = float32(v)
+	}
+	return a.mask(dr, res)
+}
+
+func (a *exprAcc) Reset() {
+	a.inner.Reset()
+	a.valid = nil
+	a.qual = nil
+}
+
+func b2f(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var (
+	exprFuncs1 = map[string]func(float64) float64{
+		"abs":   math.Abs,
+		"sqrt":  math.Sqrt,
+		"exp":   math.Exp,
+		"log":   math.Log,
+		"floor": math.Floor,
+		"ceil":  math.Ceil,
+	}
+	exprFuncs2 = map[string]func(float64, float64) float64{
+		"min": math.Min,
+		"max": math.Max,
+		"pow": math.Pow,
+	}
+)
+
+var expr_token *regexp.Regexp = regexp.MustCompile(`^(?:\d+\.?\d*(?:[eE][-+]?\d+)?|\.\d+(?:[eE][-+]?\d+)?|[A-Za-z_]\w*|&&|\|\||[<>=!]=|[-+*/()<>!,])`)
+
+// compileExpr compiles the expression src to closures. vars maps the
+// variable names to their index in the variables of an observation.
+// It also returns the number of variables the expression needs, at
+// least 1.
+func compileExpr(src string, vars map[string]int) (exprNode, int, error) {
+	fn, cond, nvars, err := compileWhere(src, vars)
+	if err == nil && cond != nil {
+		err = fmt.Errorf("invalid expression")
+	}
+	return fn, nvars, err
+}
+
+// compileWhere is compileExpr for an expression optionally followed by
+// a condition, "<expr> where <cond>". cond is nil without condition.
+func compileWhere(src string, vars map[string]int) (fn, cond exprNode, nvars int, err error) {
+	var toks []string
+	for rest := strings.TrimSpace(src); rest != ""; rest = strings.TrimSpace(rest) {
+		m := expr_token.FindStringIndex(rest)
+		if m == nil {
+			return nil, nil, 0, fmt.Errorf("invalid expression")
+		}
+		toks = append(toks, rest[:m[1]])
+		rest = rest[m[1]:]
+	}
+	p := &exprParser{toks: toks, vars: vars, nvars: 1}
+	fn, err = p.or()
+	if err == nil && p.peek() == "where" {
+		p.next()
+		cond, err = p.or()
+	}
+	if err == nil && p.pos < len(p.toks) {
+		err = fmt.Errorf("invalid expression")
+	}
+	return fn, cond, p.nvars, err
+}
+
+// exprParser is a recursive descent parser of the tokens of an
+// expression, one method per precedence level.
+type exprParser struct {
+	toks  []string
+	pos   int
+	vars  map[string]int
+	nvars int
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *exprParser) expect(t string) error {
+	if p.next() != t {
+		return fmt.Errorf("invalid expression")
+	}
+	return nil
+}
+
+func (p *exprParser) or() (exprNode, error) {
+	l, err := p.and()
+	for err == nil && p.peek() == "||" {
+		p.next()
+		var r exprNode
+		if r, err = p.and(); err == nil {
+			l0 := l
+			l = func(x []float64) float64 { return b2f(l0(x) != 0 || r(x) != 0) }
+		}
+	}
+	return l, err
+}
+
+func (p *exprParser) and() (exprNode, error) {
+	l, err := p.cmp()
+	for err == nil && p.peek() == "&&" {
+		p.next()
+		var r exprNode
+		if r, err = p.cmp(); err == nil {
+			l0 := l
+			l = func(x []float64) float64 { return b2f(l0(x) != 0 && r(x) != 0) }
+		}
+	}
+	return l, err
+}
+
+func (p *exprParser) cmp() (exprNode, error) {
+	l, err := p.add()
+	if err != nil {
+		return nil, err
+	}
+	op := p.peek()
+	switch op {
+	case "<", "<=", ">", ">=", "==", "!=":
+	default:
+		return l, nil
+	}
+	p.next()
+	r, err := p.add()
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case "<":
+		return func(x []float64) float64 { return b2f(l(x) < r(x)) }, nil
+	case "<=":
+		return func(x []float64) float64 { return b2f(l(x) <= r(x)) }, nil
+	case ">":
+		return func(x []float64) float64 { return b2f(l(x) > r(x)) }, nil
+	case ">=":
+		return func(x []float64) float64 { return b2f(l(x) >= r(x)) }, nil
+	case "==":
+		return func(x []float64) float64 { return b2f(l(x) == r(x)) }, nil
+	}
+	return func(x []float64) float64 { return b2f(l(x) != r(x)) }, nil
+}
+
+func (p *exprParser) add() (exprNode, error) {
+	l, err := p.mul()
+	for err == nil && (p.peek() == "+" || p.peek() == "-") {
+		op := p.next()
+		var r exprNode
+		if r, err = p.mul(); err == nil {
+			l0 := l
+			if op == "+" {
+				l = func(x []float64) float64 { return l0(x) + r(x) }
+			} else {
+				l = func(x []float64) float64 { return l0(x) - r(x) }
+			}
+		}
+	}
+	return l, err
+}
+
+func (p *exprParser) mul() (exprNode, error) {
+	l, err := p.unary()
+	for err == nil && (p.peek() == "*" || p.peek() == "/") {
+		op := p.next()
+		var r exprNode
+		if r, err = p.unary(); err == nil {
+			l0 := l
+			if op == "*" {
+				l = func(x []float64) float64 { return l0(x) * r(x) }
+			} else {
+				l = func(x []float64) float64 { return l0(x) / r(x) }
+			}
+		}
+	}
+	return l, err
+}
+
+func (p *exprParser) unary() (exprNode, error) {
+	switch p.peek() {
+	case "-":
+		p.next()
+		e, err := p.unary()
+		return func(x []float64) float64 { return -e(x) }, err
+	case "!":
+		p.next()
+		e, err := p.unary()
+		return func(x []float64) float64 { return b2f(e(x) == 0) }, err
+	case "+":
+		p.next()
+		return p.unary()
+	}
+	return p.primary()
+}
+
+func (p *exprParser) primary() (exprNode, error) {
+	t := p.next()
+	switch {
+	case t == "(":
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(")")
+	case t == "":
+		return nil, fmt.Errorf("invalid expression")
+	case t[0] == '.' || (t[0] >= '0' && t[0] <= '9'):
+		c, err := strconv.ParseFloat(t, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expression")
+		}
+		return func(x []float64) float64 { return c }, nil
+	}
+
+	if idx, ok := p.vars[t]; ok {
+		if idx >= p.nvars {
+			p.nvars = idx + 1
+		}
+		return func(x []float64) float64 { return x[idx] }, nil
+	}
+	if f, ok := exprFuncs1[t]; ok {
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		a, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return func(x []float64) float64 { return f(a(x)) }, p.expect(")")
+	}
+	if f, ok := exprFuncs2[t]; ok {
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		a, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		b, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return func(x []float64) float64 { return f(a(x), b(x)) }, p.expect(")")
+	}
+	return nil, fmt.Errorf("invalid expression: unknown name %s", t)
+}
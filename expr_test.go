@@ -0,0 +1,174 @@
+package reduce
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
+)
+
+func TestCompileExpr(t *testing.T) {
+	assert := assert.New(t)
+
+	for src, exp := range map[string]float64{
+		"v":                   10,
+		"-v + 2 * 3":          -4,
+		"(v - 4) / 2":         3,
+		"v > 5 && v < 20":     1,
+		"v > 5 && !(v < 20)":  0,
+		"v == 1 || v >= 10":   1,
+		"max(v - 50, 0)":      0,
+		"pow(v, 2) - sqrt(v)": 100 - math.Sqrt(10),
+		"abs(1.5e1 - v)":      5,
+	} {
+		fn, _, err := compileExpr(src, exprVars)
+		if assert.Nil(err, src) {
+			assert.InDelta(exp, fn([]float64{10}), 1e-9, src)
+		}
+	}
+
+	for _, src := range []string{"", "v +", "(v", "w", "sqrt v", "max(v)", "v $ 2", "v 2"} {
+		_, _, err := compileExpr(src, exprVars)
+		assert.NotNil(err, src)
+	}
+}
+
+func TestExprReduce(t *testing.T) {
+	assert := assert.New(t)
+	cal := &datechan.Gregorian{}
+	ctx := context.Background()
+	nan := float32(math.NaN())
+
+	days := [][]float32{
+		{40, 95, 70},
+		{60, 99, nan},
+		{90, 100, 70},
+		{55, 91, 70},
+	}
+
+	for name, expected := range map[string][]float32{
+		"gdd_50":                 {55, 185, nan},
+		"sum(max(v - 50, 0))":    {55, 185, nan},
+		"cnt(v > 90 && v < 100)": {0, 3, nan},
+		"pct(v >= 70)":           {25, 100, nan},
+		"max(abs(v - 60))":       {30, 40, nan},
+		"mean(log(v - 50))":      {nan, float32(math.Log(45*49*50*41) / 4), nan},
+		"median((v - 32) * 5/9)": {float32(57.5-32) * 5 / 9, float32(97-32) * 5 / 9, nan},
+	} {
+		var elem params.Element
+		jsonBlob := []byte(`{"vX":4, "interval":[0,0,4], "duration":4, "reduce":"` + name + `"}`)
+		err := json.Unmarshal(jsonBlob, &elem)
+		assert.Nil(err)
+		cfg, err := Setup(elem)
+		assert.Nil(err, name)
+
+		drCfg := datechan.IDconfig{
+			Interval:      elem.DateIterConfig.Interval,
+			Duration:      elem.DateIterConfig.Duration,
+			Sdate:         []int{2000, 1, 4},
+			Edate:         []int{2000, 1, 4},
+			Calendar:      cal,
+			InResolution:  3,
+			OutResolution: 3,
+		}
+		drCfg.Validate()
+		drc := datechan.New(ctx, drCfg)
+
+		inData := make(chan griddata.DataChunk, 10)
+		outData := make(chan griddata.DataChunk, 0)
+		for day, data := range days {
+			inData <- griddata.DataChunk{
+				Date: cal.YMDtoYI([]int{2000, 1, day + 1}),
+				Data: data,
+			}
+		}
+		close(inData)
+		go func() {
+			err := cfg.Func(ctx, cfg, drc, inData, outData)
+			assert.Nil(err)
+		}()
+
+		d, ok := <-outData
+		assert.True(ok)
+		for idx, v := range expected {
+			if v != v {
+				assert.True(d.Data[idx] != d.Data[idx], name)
+			} else {
+				assert.InDelta(v, d.Data[idx], 1e-4, name)
+			}
+		}
+		_, ok = <-outData
+		assert.False(ok)
+	}
+}
+
+func TestExprWhere(t *testing.T) {
+	assert := assert.New(t)
+	cal := &datechan.Gregorian{}
+	ctx := context.Background()
+	nan := float32(math.NaN())
+
+	var elem params.Element
+	jsonBlob := []byte(`{"vX":4, "interval":[0,0,4], "duration":4, "reduce":"sum(v where v > 32)","maxMissing":1}`)
+	err := json.Unmarshal(jsonBlob, &elem)
+	assert.Nil(err)
+	cfg, err := Setup(elem)
+	assert.Nil(err)
+	cfg.Companion = make(chan griddata.DataChunk, 1)
+
+	drCfg := datechan.IDconfig{
+		Interval:      elem.DateIterConfig.Interval,
+		Duration:      elem.DateIterConfig.Duration,
+		Sdate:         []int{2000, 1, 4},
+		Edate:         []int{2000, 1, 4},
+		Calendar:      cal,
+		InResolution:  3,
+		OutResolution: 3,
+	}
+	drCfg.Validate()
+	drc := datechan.New(ctx, drCfg)
+
+	inData := make(chan griddata.DataChunk, 10)
+	outData := make(chan griddata.DataChunk, 0)
+
+	days := [][]float32{
+		{40, 10, nan},
+		{20, 20, nan},
+		{nan, 30, 40},
+		{50, nan, 40},
+	}
+	for day, data := range days {
+		inData <- griddata.DataChunk{
+			Date: cal.YMDtoYI([]int{2000, 1, day + 1}),
+			Data: data,
+		}
+	}
+	close(inData)
+	go func() {
+		err := cfg.Func(ctx, cfg, drc, inData, outData)
+		assert.Nil(err)
+	}()
+
+	d, ok := <-outData
+	assert.True(ok)
+	assert.Equal(float32(90), d.Data[0])
+	assert.Equal(float32(0), d.Data[1])
+	assert.True(d.Data[2] != d.Data[2])
+
+	q, ok := <-cfg.Companion
+	assert.True(ok)
+	assert.Equal(float32(2), q.Data[0])
+	assert.Equal(float32(0), q.Data[1])
+	assert.True(q.Data[2] != q.Data[2])
+
+	_, ok = <-outData
+	assert.False(ok)
+
+	_, err = Setup(params.Element{ReduceDef: "sum(v where)"})
+	assert.NotNil(err)
+}
@@ -0,0 +1,105 @@
+package reduce
+
+import (
+	"math"
+
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+)
+
+func init() {
+	newAcc := func(config Config) Accumulator { return newExtremeAcc(config) }
+	Register("min", "minimum value", AccumulatorFactory(newAcc))
+	Register("max", "maximum value", AccumulatorFactory(newAcc))
+}
+
+// extremeEntry is one candidate in a cell's sliding window. seq is the
+// position of the observation in the input stream and date its date.
+type extremeEntry struct {
+	seq  int
+	v    float32
+	date datechan.DateIdx
+}
+
+// extremeAcc keeps, for each cell, a monotonic queue of the observations
+// that can still become the extreme of some window, so the current
+// extreme is always at the head of the queue and adding or removing an
+// observation is amortized O(1) instead of rescanning the window. Equal
+// values are kept in the queue so the earliest of them stays at the head.
+type extremeAcc struct {
+	config           Config
+	min              bool
+	queue            [][]extremeEntry
+	cnt              []int
+	firstSeq, endSeq int
+}
+
+func newExtremeAcc(config Config) *extremeAcc {
+	return &extremeAcc{
+		config: config,
+		min:    config.Name == "min" || config.Name == "argmin"}
+}
+
+// better reports whether a replaces b at the head of the queue.
+func (a *extremeAcc) better(x, y float32) bool {
+	if a.min {
+		return x < y
+	}
+	return x > y
+}
+
+func (a *extremeAcc) Add(dr datechan.DateIdxRange, dc griddata.DataChunk) {
+	if a.queue == nil {
+		a.queue = make([][]extremeEntry, len(dc.Data))
+		a.cnt = make([]int, len(dc.Data))
+	}
+	for idx, v := range dc.Data {
+		if v == v {
+			q := a.queue[idx]
+			for len(q) > 0 && a.better(v, q[len(q)-1].v) {
+				q = q[:len(q)-1]
+			}
+			a.queue[idx] = append(q, extremeEntry{seq: a.endSeq, v: v, date: dc.Date})
+			a.cnt[idx]++
+		}
+	}
+	a.endSeq++
+}
+
+func (a *extremeAcc) Remove(dc griddata.DataChunk) {
+	for idx, v := range dc.Data {
+		if v == v {
+			if q := a.queue[idx]; q[0].seq == a.firstSeq {
+				a.queue[idx] = q[1:]
+			}
+			a.cnt[idx]--
+		}
+	}
+	a.firstSeq++
+}
+
+// emit returns f of the head of the queue of each cell with enough
+// valid values, NaN for the others.
+func (a *extremeAcc) emit(dr datechan.DateIdxRange, f func(extremeEntry) float32) []float32 {
+	nan := float32(math.NaN())
+	expCnt := dr.Len()
+	res := make([]float32, len(a.queue))
+	for idx, q := range a.queue {
+		if expCnt-a.cnt[idx] <= a.config.MaxMissing && a.cnt[idx] > 0 {
+			res[idx] = f(q[0])
+		} else {
+			res[idx] = nan
+		}
+	}
+	return res
+}
+
+func (a *extremeAcc) Emit(dr datechan.DateIdxRange) []float32 {
+	return a.emit(dr, func(e extremeEntry) float32 { return e.v })
+}
+
+func (a *extremeAcc) Reset() {
+	a.queue = nil
+	a.cnt = nil
+	a.firstSeq, a.endSeq = 0, 0
+}
@@ -0,0 +1,136 @@
+package reduce
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
+)
+
+func TestMinMissing(t *testing.T) {
+	assert := assert.New(t)
+	cal := &datechan.Gregorian{}
+	ctx := context.Background()
+
+	var elem params.Element
+	jsonBlob := []byte(`{"vX":4, "interval":[0,0,4], "duration":4, "reduce":"min","maxMissing":1}`)
+	err := json.Unmarshal(jsonBlob, &elem)
+	assert.Nil(err)
+	nan := float32(math.NaN())
+	cfg, err := Setup(elem)
+	assert.Nil(err)
+
+	drCfg := datechan.IDconfig{
+		Interval:      elem.DateIterConfig.Interval,
+		Duration:      elem.DateIterConfig.Duration,
+		Sdate:         []int{2000, 1, 4},
+		Edate:         []int{2000, 1, 4},
+		Calendar:      cal,
+		InResolution:  3,
+		OutResolution: 3,
+	}
+	drCfg.Validate()
+	assert.False(drCfg.IsOverlapping())
+	drc := datechan.New(ctx, drCfg)
+
+	inData := make(chan griddata.DataChunk, 10)
+	outData := make(chan griddata.DataChunk, 0)
+
+	inData <- griddata.DataChunk{
+		Date: cal.YMDtoYI([]int{2000, 1, 1}),
+		Data: []float32{3, nan, nan, -1},
+	}
+	inData <- griddata.DataChunk{
+		Date: cal.YMDtoYI([]int{2000, 1, 2}),
+		Data: []float32{1, 2, nan, -4},
+	}
+	inData <- griddata.DataChunk{
+		Date: cal.YMDtoYI([]int{2000, 1, 3}),
+		Data: []float32{2, 5, 1, -2},
+	}
+	inData <- griddata.DataChunk{
+		Date: cal.YMDtoYI([]int{2000, 1, 4}),
+		Data: []float32{4, 3, 0, -3},
+	}
+	close(inData)
+	go func() {
+		err := cfg.Func(ctx, cfg, drc, inData, outData)
+		assert.Nil(err)
+	}()
+	d, ok := <-outData
+	assert.True(ok)
+	assert.Equal(4, len(d.Data))
+	assert.Equal(float32(1), d.Data[0])
+	assert.Equal(float32(2), d.Data[1])
+	assert.False(d.Data[2] == d.Data[2])
+	assert.Equal(float32(-4), d.Data[3])
+}
+
+func TestMaxOverlap(t *testing.T) {
+	assert := assert.New(t)
+	cal := &datechan.Gregorian{}
+	ctx := context.Background()
+
+	var elem params.Element
+	jsonBlob := []byte(`{"vX":4, "interval":[0,0,1], "duration":3, "reduce":"max","maxMissing":1}`)
+	err := json.Unmarshal(jsonBlob, &elem)
+	assert.Nil(err)
+	nan := float32(math.NaN())
+	cfg, err := Setup(elem)
+	assert.Nil(err)
+
+	drCfg := datechan.IDconfig{
+		Interval:      elem.DateIterConfig.Interval,
+		Duration:      elem.DateIterConfig.Duration,
+		Sdate:         []int{2000, 1, 3},
+		Edate:         []int{2000, 1, 6},
+		Calendar:      cal,
+		InResolution:  3,
+		OutResolution: 3,
+	}
+	drCfg.Validate()
+	assert.True(drCfg.IsOverlapping())
+	drc := datechan.New(ctx, drCfg)
+
+	inData := make(chan griddata.DataChunk, 10)
+	outData := make(chan griddata.DataChunk, 0)
+
+	days := [][]float32{
+		{1, nan},
+		{5, 4},
+		{2, 4},
+		{3, nan},
+		{1, 1},
+		{0, 2},
+	}
+	for day, data := range days {
+		inData <- griddata.DataChunk{
+			Date: cal.YMDtoYI([]int{2000, 1, day + 1}),
+			Data: data,
+		}
+	}
+	close(inData)
+	go func() {
+		err := cfg.Func(ctx, cfg, drc, inData, outData)
+		assert.Nil(err)
+	}()
+
+	expected := [][]float32{
+		{5, 4},
+		{5, 4},
+		{3, 4},
+		{3, 2},
+	}
+	for _, exp := range expected {
+		d, ok := <-outData
+		assert.True(ok)
+		assert.Equal(exp, d.Data)
+	}
+	_, ok := <-outData
+	assert.False(ok)
+}
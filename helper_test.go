@@ -0,0 +1,79 @@
+package reduce
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
+)
+
+// runDaily runs the reduction of the element elemJSON over its daily
+// date ranges ending from sdate to edate, reading days, the chunks of
+// January 1, 2000 on, and returns the data of the output chunks. A nil
+// day is absent from the input.
+func runDaily(t *testing.T, elemJSON string, sdate, edate []int, days [][]float32) [][]float32 {
+	assert := assert.New(t)
+	cal := &datechan.Gregorian{}
+	ctx := context.Background()
+
+	var elem params.Element
+	err := json.Unmarshal([]byte(elemJSON), &elem)
+	assert.Nil(err)
+	cfg, err := Setup(elem)
+	assert.Nil(err, elemJSON)
+
+	drCfg := datechan.IDconfig{
+		Interval:      elem.DateIterConfig.Interval,
+		Duration:      elem.DateIterConfig.Duration,
+		Sdate:         sdate,
+		Edate:         edate,
+		Calendar:      cal,
+		InResolution:  3,
+		OutResolution: 3,
+	}
+	drCfg.Validate()
+	drc := datechan.New(ctx, drCfg)
+
+	inData := make(chan griddata.DataChunk, len(days))
+	outData := make(chan griddata.DataChunk, 0)
+	for i, data := range days {
+		if data == nil {
+			continue
+		}
+		day := time.Date(2000, 1, 1+i, 0, 0, 0, 0, time.UTC)
+		inData <- griddata.DataChunk{
+			Date: cal.YMDtoYI([]int{day.Year(), int(day.Month()), day.Day()}),
+			Data: data,
+		}
+	}
+	close(inData)
+	go func() {
+		err := cfg.Func(ctx, cfg, drc, inData, outData)
+		assert.Nil(err)
+	}()
+
+	var res [][]float32
+	for d := range outData {
+		res = append(res, d.Data)
+	}
+	return res
+}
+
+// assertData asserts that data matches expected, NaN matching NaN.
+func assertData(t *testing.T, expected, data []float32, msg string) {
+	if !assert.Len(t, data, len(expected), msg) {
+		return
+	}
+	for idx, v := range expected {
+		if v != v {
+			assert.True(t, data[idx] != data[idx], "%s [%d] %v", msg, idx, data[idx])
+		} else {
+			assert.InDelta(t, v, data[idx], 1e-4, "%s [%d]", msg, idx)
+		}
+	}
+}
@@ -4,138 +4,44 @@ import (
 	"context"
 	"math"
 
-	alog "github.com/apex/log"
-
 	"gitlab.com/bnoon/datechan"
 	"gitlab.com/bnoon/griddata"
 )
 
-func Mean(ctx context.Context,
-	config Config,
-	drc datechan.DateRangeChannel,
-	inData, outData chan griddata.DataChunk) error {
-
-	defer close(outData)
-
-	nan := float32(math.NaN())
-
-	var (
-		dr             datechan.DateIdxRange
-		last_start     datechan.DateIdx
-		inDC, inDC1    griddata.DataChunk
-		dr_ok, inDC_ok bool
-		obsCnt         int
-		sum            []float32
-		cnt            []int
-	)
-
-	nextRange := func() error {
-		if obsCnt > 0 {
-			expCnt := dr.Len()
-			mean := make([]float32, len(sum))
-			for idx, v := range sum {
-				if expCnt-cnt[idx] <= config.MaxMissing && cnt[idx] > 0 {
-					mean[idx] = v / float32(cnt[idx])
-				} else {
-					mean[idx] = nan
-				}
-			}
-
-			last_start = dr.Start.Copy()
-			outDC := griddata.DataChunk{
-				Date:   dr.Resample(inDC1.Date),
-				Offset: inDC1.Offset,
-				Length: inDC1.Length,
-				Data:   mean}
-
-			select {
-			case outData <- outDC:
-			case <-ctx.Done():
-				return ctx.Err()
-			}
-		}
-
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case dr, dr_ok = <-drc:
-		}
-
-		if !(dr_ok && dr.Start.Equal(last_start)) {
-			sum = nil
-			obsCnt = 0
-		}
-		return nil
-	}
+func init() {
+	Register("mean", "mean of the valid values", AccumulatorFactory(newMeanAcc))
+}
 
-	if err := nextRange(); err != nil {
-		return err
-	}
+// meanAcc is sumAcc divided by the count of valid values.
+type meanAcc struct {
+	sumAcc
+}
 
-dataLoop:
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case inDC, inDC_ok = <-inData:
-		}
-		if !inDC_ok {
-			break
-		}
+func newMeanAcc(config Config) Accumulator {
+	return &meanAcc{sumAcc{config: config}}
+}
 
-		if inDC.Date.Less(dr.Start) {
-			alog.Debugf("skip %s < %s", inDC.Date.Key(), dr.Start.Key())
-			continue
-		}
-		if inDC.Date.Less(dr.End) || inDC.Date.Equal(dr.End) {
-			// alog.Debugf("add %s", inDC.Date.Key())
-			if sum == nil {
-				sum = make([]float32, len(inDC.Data))
-				cnt = make([]int, len(inDC.Data))
-			}
-			for idx, v := range inDC.Data {
-				if v == v {
-					sum[idx] += v
-					cnt[idx]++
-				}
-			}
-			obsCnt++
-			inDC1 = inDC
-		}
-		if !inDC.Date.Less(dr.End) {
-			// alog.Debugf("done? %d %s >= %s", obsCnt, inDC.Date.Key(), dr.End.Key())
-			for {
-				if err := nextRange(); err != nil {
-					return err
-				}
-				if !dr_ok {
-					break dataLoop
-				}
-				if !dr.End.Less(inDC.Date) {
-					break
-				}
-				alog.Debugf("skip+ %s >= %s", inDC.Date.Key(), dr.End.Key())
-			}
+func (a *meanAcc) Emit(dr datechan.DateIdxRange) []float32 {
+	nan := float32(math.NaN())
+	expCnt := dr.Len()
+	mean := make([]float32, len(a.sum))
+	for idx, v := range a.sum {
+		if expCnt-a.cnt[idx] <= a.config.MaxMissing && a.cnt[idx] > 0 {
+			mean[idx] = v / float32(a.cnt[idx])
+		} else {
+			mean[idx] = nan
 		}
 	}
+	return mean
+}
 
-	if err := nextRange(); err != nil {
-		return err
-	}
-
-	// drain data channel??
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case inDC, inDC_ok = <-inData:
-			if !inDC_ok {
-				return nil
-			}
-		}
-	}
+func Mean(ctx context.Context,
+	config Config,
+	drc datechan.DateRangeChannel,
+	inData, outData chan griddata.DataChunk) error {
 
-	return nil
+	config.Overlapping = false
+	return Accumulate(ctx, config, newMeanAcc(config), drc, inData, outData)
 }
 
 func MeanOverlap(ctx context.Context,
@@ -143,151 +49,6 @@ func MeanOverlap(ctx context.Context,
 	drc datechan.DateRangeChannel,
 	inData, outData chan griddata.DataChunk) error {
 
-	defer close(outData)
-
-	nan := float32(math.NaN())
-
-	var (
-		dr              datechan.DateIdxRange
-		inDC            griddata.DataChunk
-		dr_ok, inDC_ok  bool
-		obsCnt          int
-		sum             []float32
-		cnt             []int
-		firstDC, lastDC *dataListItem
-	)
-
-	nextRange := func() error {
-		if obsCnt > 0 {
-			expCnt := dr.Len()
-			mean := make([]float32, len(sum))
-			for idx, v := range sum {
-				if expCnt-cnt[idx] <= config.MaxMissing && cnt[idx] > 0 {
-					mean[idx] = v / float32(cnt[idx])
-				} else {
-					mean[idx] = nan
-				}
-			}
-			outDC := griddata.DataChunk{
-				Date:   dr.Resample(lastDC.data.Date),
-				Offset: lastDC.data.Offset,
-				Length: lastDC.data.Length,
-				Data:   mean}
-
-			select {
-			case outData <- outDC:
-			case <-ctx.Done():
-				return ctx.Err()
-			}
-		}
-
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case dr, dr_ok = <-drc:
-		}
-
-		if dr_ok {
-			for firstDC != nil {
-				if firstDC.data.Date.Less(dr.Start) { // no longer in daterange
-					// handle removing data:
-					//   subtract data for sum/mean reduction
-					//   test threshold and adjust count
-					//   min/max, just remove
-					for idx, v := range firstDC.data.Data {
-						if v == v {
-							sum[idx] -= v
-							cnt[idx]--
-						}
-					}
-					obsCnt--
-					firstDC = firstDC.next
-					if firstDC == nil {
-						lastDC = nil
-						sum = nil
-					}
-				} else {
-					break
-				}
-			}
-		} else {
-			// obsCnt is a flag
-			obsCnt = 0
-		}
-		return nil
-	}
-
-	if err := nextRange(); err != nil {
-		return err
-	}
-
-dataLoop:
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case inDC, inDC_ok = <-inData:
-		}
-		if !inDC_ok {
-			break
-		}
-
-		if inDC.Date.Less(dr.Start) {
-			alog.Debugf("skip %s < %s", inDC.Date.Key(), dr.Start.Key())
-			continue
-		}
-		if inDC.Date.Less(dr.End) || inDC.Date.Equal(dr.End) {
-			if sum == nil {
-				sum = make([]float32, len(inDC.Data))
-				cnt = make([]int, len(inDC.Data))
-			}
-			for idx, v := range inDC.Data {
-				if v == v {
-					sum[idx] += v
-					cnt[idx]++
-				}
-			}
-			obsCnt++
-			if firstDC == nil {
-				firstDC = &dataListItem{data: inDC}
-				lastDC = firstDC
-			} else {
-				nextDC := &dataListItem{data: inDC}
-				lastDC.next = nextDC
-				lastDC = nextDC
-			}
-		}
-		if !inDC.Date.Less(dr.End) {
-			for {
-				if err := nextRange(); err != nil {
-					return err
-				}
-				if !dr_ok {
-					break dataLoop
-				}
-				if !dr.End.Less(inDC.Date) {
-					break
-				}
-				alog.Debugf("skip+ %s >= %s", inDC.Date.Key(), dr.End.Key())
-			}
-		}
-	}
-
-	if err := nextRange(); err != nil {
-		return err
-	}
-
-	// drain data channel??
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case inDC, inDC_ok = <-inData:
-			if !inDC_ok {
-				return nil
-			}
-		}
-	}
-
-	return nil
+	config.Overlapping = true
+	return Accumulate(ctx, config, newMeanAcc(config), drc, inData, outData)
 }
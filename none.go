@@ -3,115 +3,73 @@ package reduce
 import (
 	"context"
 
-	alog "github.com/apex/log"
-
 	"gitlab.com/bnoon/datechan"
 	"gitlab.com/bnoon/griddata"
 )
 
+func init() {
+	Register("none", "no reduction, date aligned chunks with nil Data",
+		AccumulatorFactory(func(Config) Accumulator { return noneAcc{} }))
+	Register("first", "first observation of the range", AccumulatorFactory(newPassAcc))
+	Register("last", "last observation of the range", AccumulatorFactory(newPassAcc))
+}
+
 type dataListItem struct {
 	data griddata.DataChunk
 	next *dataListItem
 }
 
-func None(ctx context.Context,
-	config Config,
-	drc datechan.DateRangeChannel,
-	inData, outData chan griddata.DataChunk) error {
-
-	defer close(outData)
+// passAcc passes the first or last observation of a range through,
+// missing values included; MaxMissing does not apply. The data is copied
+// on Emit, chunks may be emitted for several ranges.
+type passAcc struct {
+	last bool
+	data []float32
+}
 
-	var (
-		dr             datechan.DateIdxRange
-		last_start     datechan.DateIdx
-		inDC, inDC1    griddata.DataChunk
-		dr_ok, inDC_ok bool
-		obsCnt         int
-	)
+func newPassAcc(config Config) Accumulator {
+	return &passAcc{last: config.Name == "last"}
+}
 
-	nextRange := func() error {
-		if obsCnt > 0 {
-			last_start = dr.Start.Copy()
-			outDC := griddata.DataChunk{
-				Date:   dr.Resample(inDC1.Date),
-				Offset: inDC1.Offset,
-				Length: inDC1.Length,
-				Data:   nil}
-			select {
-			case outData <- outDC:
-			case <-ctx.Done():
-				return ctx.Err()
-			}
-		}
+func (a *passAcc) Add(dr datechan.DateIdxRange, dc griddata.DataChunk) {
+	if a.data == nil || a.last {
+		a.data = dc.Data
+	}
+}
 
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case dr, dr_ok = <-drc:
-		}
+func (a *passAcc) Emit(dr datechan.DateIdxRange) []float32 {
+	return append([]float32(nil), a.data...)
+}
 
-		if !(dr_ok && dr.Start.Equal(last_start)) {
-			obsCnt = 0
-		}
-		return nil
-	}
+func (a *passAcc) Reset() {
+	a.data = nil
+}
 
-	if err := nextRange(); err != nil {
-		return err
-	}
+// noneAcc only marks the ranges with data.
+type noneAcc struct{}
 
-dataLoop:
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case inDC, inDC_ok = <-inData:
-		}
-		if !inDC_ok {
-			break
-		}
+func (noneAcc) Add(dr datechan.DateIdxRange, dc griddata.DataChunk) {}
+func (noneAcc) Remove(dc griddata.DataChunk)                        {}
+func (noneAcc) Emit(dr datechan.DateIdxRange) []float32             { return nil }
+func (noneAcc) Reset()                                              {}
 
-		if inDC.Date.Less(dr.Start) {
-			alog.Debugf("skip %s < %s", inDC.Date.Key(), dr.Start.Key())
-			continue
-		}
-		if inDC.Date.Less(dr.End) || inDC.Date.Equal(dr.End) {
-			// alog.Debugf("add %s", inDC.Date.Key())
-			obsCnt++
-			inDC1 = inDC
-		}
-		if !inDC.Date.Less(dr.End) {
-			// alog.Debugf("done? %d %s >= %s", obsCnt, inDC.Date.Key(), dr.End.Key())
-			for {
-				if err := nextRange(); err != nil {
-					return err
-				}
-				if !dr_ok {
-					break dataLoop
-				}
-				if !dr.End.Less(inDC.Date) {
-					break
-				}
-				alog.Debugf("skip+ %s >= %s", inDC.Date.Key(), dr.End.Key())
-			}
-		}
-	}
+// None emits one chunk for each date range with observations, dated and
+// placed like the chunks of the other reductions but with Data nil. It
+// is used to align dates without reducing the data.
+func None(ctx context.Context,
+	config Config,
+	drc datechan.DateRangeChannel,
+	inData, outData chan griddata.DataChunk) error {
 
-	if err := nextRange(); err != nil {
-		return err
-	}
+	return Accumulate(ctx, config, noneAcc{}, drc, inData, outData)
+}
 
-	// drain data channel??
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case inDC, inDC_ok = <-inData:
-			if !inDC_ok {
-				return nil
-			}
-		}
-	}
+// NoneOverlap is None for overlapping date ranges.
+func NoneOverlap(ctx context.Context,
+	config Config,
+	drc datechan.DateRangeChannel,
+	inData, outData chan griddata.DataChunk) error {
 
-	return nil
+	config.Overlapping = true
+	return Accumulate(ctx, config, noneAcc{}, drc, inData, outData)
 }
@@ -0,0 +1,87 @@
+package reduce
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
+)
+
+func TestPass(t *testing.T) {
+	assert := assert.New(t)
+	cal := &datechan.Gregorian{}
+	ctx := context.Background()
+	nan := float32(math.NaN())
+
+	days := [][]float32{
+		{1, nan},
+		{2, 4},
+		{3, 5},
+		{nan, 6},
+	}
+
+	for name, expected := range map[string][][]float32{
+		"none":  {nil, nil},
+		"first": {{1, nan}, {3, 5}},
+		"last":  {{2, 4}, {nan, 6}},
+	} {
+		var elem params.Element
+		jsonBlob := []byte(`{"vX":4, "interval":[0,0,2], "duration":2, "reduce":"` + name + `"}`)
+		err := json.Unmarshal(jsonBlob, &elem)
+		assert.Nil(err)
+		cfg, err := Setup(elem)
+		assert.Nil(err)
+
+		drCfg := datechan.IDconfig{
+			Interval:      elem.DateIterConfig.Interval,
+			Duration:      elem.DateIterConfig.Duration,
+			Sdate:         []int{2000, 1, 2},
+			Edate:         []int{2000, 1, 4},
+			Calendar:      cal,
+			InResolution:  3,
+			OutResolution: 3,
+		}
+		drCfg.Validate()
+		drc := datechan.New(ctx, drCfg)
+
+		inData := make(chan griddata.DataChunk, 10)
+		outData := make(chan griddata.DataChunk, 0)
+		for day, data := range days {
+			inData <- griddata.DataChunk{
+				Date: cal.YMDtoYI([]int{2000, 1, day + 1}),
+				Data: data,
+			}
+		}
+		close(inData)
+		go func() {
+			err := cfg.Func(ctx, cfg, drc, inData, outData)
+			assert.Nil(err)
+		}()
+
+		for _, exp := range expected {
+			d, ok := <-outData
+			assert.True(ok)
+			if exp == nil {
+				assert.Nil(d.Data, name)
+				continue
+			}
+			for idx, v := range exp {
+				if v != v {
+					assert.True(d.Data[idx] != d.Data[idx], name)
+				} else {
+					assert.Equal(v, d.Data[idx], name)
+				}
+			}
+			d.Data[0] = -1 // output is a copy
+		}
+		_, ok := <-outData
+		assert.False(ok)
+	}
+	assert.Equal([]float32{2, 4}, days[1])
+	assert.Equal([]float32{3, 5}, days[2])
+}
@@ -0,0 +1,85 @@
+package reduce
+
+import (
+	"math"
+	"regexp"
+
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+)
+
+var occurrence_pattern *regexp.Regexp = regexp.MustCompile(`^(first|last)` + thresholdOps + `$`)
+
+func init() {
+	RegisterPattern(occurrence_pattern,
+		"offset of the first or last value meeting a threshold, e.g. first_le_32",
+		thresholdFactory(occurrence_pattern, newOccurrenceAcc))
+}
+
+// offsetIn returns the offset of date from the start of dr, 0 for the
+// first date of the range.
+func offsetIn(dr datechan.DateIdxRange, date datechan.DateIdx) float32 {
+	return float32(datechan.DateIdxRange{Start: dr.Start, End: date}.Len() - 1)
+}
+
+// occurrenceResult masks the occurrence offsets of cells missing more
+// than MaxMissing of the expCnt expected values.
+func occurrenceResult(config Config, pos []float32, cnt []int, expCnt int) []float32 {
+	nan := float32(math.NaN())
+	res := make([]float32, len(pos))
+	for idx, v := range pos {
+		if expCnt-cnt[idx] > config.MaxMissing {
+			res[idx] = nan
+		} else {
+			res[idx] = v
+		}
+	}
+	return res
+}
+
+// occurrenceAcc keeps the offset of the first or last occurrence in
+// each cell, NaN without one. Offsets count from 0 at the start of the
+// range, so the driver rebuilds it for overlapping ranges.
+type occurrenceAcc struct {
+	config Config
+	test   func(float32) bool
+	first  bool
+	pos    []float32
+	cnt    []int
+}
+
+func newOccurrenceAcc(config Config) Accumulator {
+	return &occurrenceAcc{
+		config: config,
+		test:   thresholdFunc(config),
+		first:  config.ThresholdType == "first"}
+}
+
+func (a *occurrenceAcc) Add(dr datechan.DateIdxRange, dc griddata.DataChunk) {
+	if a.pos == nil {
+		nan := float32(math.NaN())
+		a.pos = make([]float32, len(dc.Data))
+		a.cnt = make([]int, len(dc.Data))
+		for idx := range a.pos {
+			a.pos[idx] = nan
+		}
+	}
+	offset := offsetIn(dr, dc.Date)
+	for idx, v := range dc.Data {
+		if v == v {
+			a.cnt[idx]++
+			if a.test(v) && (!a.first || a.pos[idx] != a.pos[idx]) {
+				a.pos[idx] = offset
+			}
+		}
+	}
+}
+
+func (a *occurrenceAcc) Emit(dr datechan.DateIdxRange) []float32 {
+	return occurrenceResult(a.config, a.pos, a.cnt, dr.Len())
+}
+
+func (a *occurrenceAcc) Reset() {
+	a.pos = nil
+	a.cnt = nil
+}
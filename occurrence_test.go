@@ -0,0 +1,56 @@
+package reduce
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOccurrence(t *testing.T) {
+	nan := float32(math.NaN())
+	days := [][]float32{
+		{40, 40, nan, 30},
+		{30, 40, nan, nan},
+		{40, 40, 30, 40},
+		{30, 40, 40, 40},
+		{40, 40, 40, 40},
+	}
+
+	for reduce, exp := range map[string][]float32{
+		"first_le_32": {1, nan, nan, 0},
+		"last_le_32":  {3, nan, nan, 0},
+		"first_gt_32": {0, 0, nan, 2},
+		"last_gt_32":  {4, 4, nan, 4},
+	} {
+		res := runDaily(t, `{"vX":4, "interval":[0,0,5], "duration":5, "reduce":"`+reduce+`","maxMissing":1}`,
+			[]int{2000, 1, 5}, []int{2000, 1, 5}, days)
+		if assert.Len(t, res, 1, reduce) {
+			assertData(t, exp, res[0], reduce)
+		}
+	}
+
+	res := runDaily(t, `{"vX":4, "interval":[0,0,5], "duration":5, "reduce":"first_le_32","maxMissing":2}`,
+		[]int{2000, 1, 5}, []int{2000, 1, 5}, days)
+	if assert.Len(t, res, 1) {
+		assertData(t, []float32{1, nan, 2, 0}, res[0], "maxMissing 2")
+	}
+}
+
+func TestOccurrenceOverlap(t *testing.T) {
+	days := [][]float32{{40}, {30}, {40}, {30}, {40}}
+
+	// three day windows ending January 3, 4 and 5
+	for reduce, exp := range map[string][]float32{
+		"first_le_32": {1, 0, 1},
+		"last_le_32":  {1, 2, 1},
+	} {
+		res := runDaily(t, `{"vX":4, "interval":[0,0,1], "duration":3, "reduce":"`+reduce+`"}`,
+			[]int{2000, 1, 3}, []int{2000, 1, 5}, days)
+		if assert.Len(t, res, len(exp), reduce) {
+			for i := range exp {
+				assertData(t, exp[i:i+1], res[i], reduce)
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package reduce
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
+)
+
+var percentile_pattern *regexp.Regexp = regexp.MustCompile(`^pctl_(\d*\.?\d*)$`)
+
+func init() {
+	Register("median", "median, interpolated as pctl_50",
+		func(elem params.Element) (Config, error) {
+			cfg, _ := AccumulatorFactory(newPercentileAcc)(elem)
+			cfg.Percentile = 50
+			return cfg, nil
+		})
+	RegisterPattern(percentile_pattern,
+		"percentile, linearly interpolated between the closest ranks, e.g. pctl_90",
+		func(elem params.Element) (Config, error) {
+			cfg, _ := AccumulatorFactory(newPercentileAcc)(elem)
+			m := percentile_pattern.FindStringSubmatch(elem.ReduceDef)
+			pVal, err := strconv.ParseFloat(m[1], 32)
+			if err != nil || pVal < 0 || pVal > 100 {
+				return cfg, fmt.Errorf("invalid percentile")
+			}
+			cfg.Percentile = float32(pVal)
+			return cfg, nil
+		})
+}
+
+type float32s []float32
+
+func (x float32s) Len() int           { return len(x) }
+func (x float32s) Less(i, j int) bool { return x[i] < x[j] }
+func (x float32s) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+
+// percentile interpolates the p-th (0-100) percentile of sorted, which
+// must not be empty. Values are interpolated linearly between the two
+// closest ranks, h = (n-1)*p/100 (Hyndman & Fan type 7, the default in
+// R and numpy).
+func percentile(sorted []float32, p float32) float32 {
+	h := float64(len(sorted)-1) * float64(p) / 100.
+	lo := int(math.Floor(h))
+	if lo+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	frac := float32(h - float64(lo))
+	return sorted[lo] + frac*(sorted[lo+1]-sorted[lo])
+}
+
+// quantile8 interpolates the p-th (0-100) percentile of sorted, which
+// must not be empty, at h = (n+1/3)*p/100 + 1/3 (Hyndman & Fan type 8,
+// the median-unbiased estimator the ETCCDI indices use).
+func quantile8(sorted []float32, p float32) float32 {
+	n := float64(len(sorted))
+	h := (n+1./3)*float64(p)/100. + 1./3
+	if h <= 1 {
+		return sorted[0]
+	}
+	if h >= n {
+		return sorted[len(sorted)-1]
+	}
+	lo := int(math.Floor(h))
+	frac := float32(h - float64(lo))
+	return sorted[lo-1] + frac*(sorted[lo]-sorted[lo-1])
+}
+
+// percentileAcc keeps the valid values of each cell. Values are appended
+// and sorted when needed, since the values of non-overlapping ranges are
+// only sorted once.
+type percentileAcc struct {
+	config Config
+	vals   [][]float32
+	sorted bool
+}
+
+func newPercentileAcc(config Config) Accumulator {
+	return &percentileAcc{config: config}
+}
+
+func (a *percentileAcc) sort() {
+	if !a.sorted {
+		for _, v := range a.vals {
+			sort.Sort(float32s(v))
+		}
+		a.sorted = true
+	}
+}
+
+func (a *percentileAcc) Add(dr datechan.DateIdxRange, dc griddata.DataChunk) {
+	if a.vals == nil {
+		a.vals = make([][]float32, len(dc.Data))
+	}
+	for idx, v := range dc.Data {
+		if v == v {
+			a.vals[idx] = append(a.vals[idx], v)
+		}
+	}
+	a.sorted = false
+}
+
+func (a *percentileAcc) Remove(dc griddata.DataChunk) {
+	a.sort()
+	for idx, v := range dc.Data {
+		if v == v {
+			s := a.vals[idx]
+			i := sort.Search(len(s), func(i int) bool { return s[i] >= v })
+			a.vals[idx] = append(s[:i], s[i+1:]...)
+		}
+	}
+}
+
+func (a *percentileAcc) Emit(dr datechan.DateIdxRange) []float32 {
+	nan := float32(math.NaN())
+	a.sort()
+	expCnt := dr.Len()
+	res := make([]float32, len(a.vals))
+	for idx, v := range a.vals {
+		if expCnt-len(v) <= a.config.MaxMissing && len(v) > 0 {
+			res[idx] = percentile(v, a.config.Percentile)
+		} else {
+			res[idx] = nan
+		}
+	}
+	return res
+}
+
+func (a *percentileAcc) Reset() {
+	a.vals = nil
+}
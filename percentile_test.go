@@ -0,0 +1,46 @@
+package reduce
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/bnoon/griddata/params"
+)
+
+func TestPercentile(t *testing.T) {
+	nan := float32(math.NaN())
+
+	days := [][]float32{
+		{1, 4, nan},
+		{2, nan, nan},
+		{3, 1, 5},
+		{4, 10, 6},
+	}
+	for name, expected := range map[string][]float32{
+		"median":   {2.5, 4, nan},
+		"pctl_90":  {3.7, 8.8, nan},
+		"pctl_0":   {1, 1, nan},
+		"pctl_100": {4, 10, nan},
+	} {
+		res := runDaily(t, `{"vX":4, "interval":[0,0,4], "duration":4, "reduce":"`+name+`","maxMissing":1}`,
+			[]int{2000, 1, 4}, []int{2000, 1, 4}, days)
+		if assert.Len(t, res, 1, name) {
+			assertData(t, expected, res[0], name)
+		}
+	}
+
+	// two day windows, each day leaving the window in turn
+	res := runDaily(t, `{"vX":4, "interval":[0,0,1], "duration":2, "reduce":"median","maxMissing":1}`,
+		[]int{2000, 1, 2}, []int{2000, 1, 4}, days)
+	if assert.Len(t, res, 3) {
+		assertData(t, []float32{1.5, 4, nan}, res[0], "Jan 2")
+		assertData(t, []float32{2.5, 1, 5}, res[1], "Jan 3")
+		assertData(t, []float32{3.5, 5.5, 5.5}, res[2], "Jan 4")
+	}
+
+	for _, name := range []string{"pctl_101", "pctl_x"} {
+		_, err := Setup(params.Element{ReduceDef: name})
+		assert.NotNil(t, err, name)
+	}
+}
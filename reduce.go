@@ -3,74 +3,101 @@ package reduce
 import (
 	"context"
 	"fmt"
-	"regexp"
-	"strconv"
 
 	"gitlab.com/bnoon/datechan"
 	"gitlab.com/bnoon/griddata"
 	"gitlab.com/bnoon/griddata/params"
 )
 
+// Func runs a reduction, reading inData and writing one chunk per date
+// range of drc to outData, which it closes on return.
+type Func func(
+	context.Context,
+	Config,
+	datechan.DateRangeChannel,
+	chan griddata.DataChunk,
+	chan griddata.DataChunk) error
+
 type Config struct {
-	Name string
-	Func func(
-		context.Context,
-		Config,
-		datechan.DateRangeChannel,
-		chan griddata.DataChunk,
-		chan griddata.DataChunk) error
+	Name           string
+	Func           Func
 	Overlapping    bool
 	DateRanges     chan datechan.DateRangeChannel
 	MaxMissing     int
 	Threshold      string
+	ThresholdType  string
 	ThresholdValue float32
+	ThresholdUpper float32
+	MinRun         int
+	Percentile     float32
+	Expr           *Expr
+	// MaxMissingYears is the number of years of a position in the year
+	// that may be missing, n of "clim<n>_"; see Climatology.
+	MaxMissingYears int
+	// Normals is the climatology of the anomaly reductions.
+	Normals *Normals
+	// Calibration is the calibration period of the standardized indices.
+	Calibration *Calibration
+	// Baseline is the base period of the percentile reductions.
+	Baseline *Baseline
+	// Needs names the field above the reduction cannot run without,
+	// if any, e.g. "Baseline" or "Baseline.WetDay". See checkNeeds.
+	Needs string
+	// Split is the month and day between spring and fall of the season
+	// reductions, see GrowingSeason.
+	Split []int
+	// NewAccumulator makes the Accumulator of reductions computed by one,
+	// see AccumulatorFactory. It is nil for other reductions.
+	NewAccumulator func(Config) Accumulator
+	// Calendar is the calendar of the date iteration, in which the
+	// reductions such as Climatology and Anomaly take the month and day
+	// of their dates. NewConfig sets the Gregorian calendar.
+	Calendar datechan.Calendar
+	// Vars is the number of input variables of the reduction, 0 being
+	// the same as 1. See RunMulti.
+	Vars int
+	// Companion receives the secondary result of reductions that have
+	// one, such as the extreme values of argmax; see Accumulate.
+	Companion chan griddata.DataChunk
 }
 
-var (
-	threshold_pattern *regexp.Regexp = regexp.MustCompile(`^(cnt)_(lt|gt|le|ge|eq)_([-+]?\d*\.?\d*)$`)
-
-// threshold_pattern *regexp.Regexp = regexp.MustCompile(`^(cnt|pct|fct)_(eq|lt|le|gt|ge|ne)_([-+]?\d*\.?\d*)$`)
-)
-
-func Setup(elem params.Element) (Config, error) {
-	cfg := Config{
+// NewConfig returns the part of the Config of elem common to all
+// reductions.
+func NewConfig(elem params.Element) Config {
+	return Config{
 		Name:        elem.ReduceDef,
 		Overlapping: elem.DateIterConfig.IsOverlapping(),
 		MaxMissing:  elem.MaxMissing,
+		Calendar:    &datechan.Gregorian{},
 	}
-	if cfg.Name == "mean" {
-		if cfg.Overlapping {
-			cfg.Func = MeanOverlap
-		} else {
-			cfg.Func = Mean
-		}
-		return cfg, nil
-	}
+}
 
-	if cfg.Name == "sum" {
-		if cfg.Overlapping {
-			cfg.Func = SumOverlap
-		} else {
-			cfg.Func = Sum
-		}
-		return cfg, nil
+// Setup returns the Config of the reduction registered for
+// elem.ReduceDef. See Reductions for the available names.
+func Setup(elem params.Element) (Config, error) {
+	r, err := lookup(elem.ReduceDef)
+	if err != nil {
+		return NewConfig(elem), err
 	}
+	return r.Factory(elem)
+}
 
-	tHold := threshold_pattern.FindStringSubmatch(cfg.Name)
-	if len(tHold) > 0 {
-		tVal, err := strconv.ParseFloat(tHold[3], 32)
-		if err != nil {
-			return cfg, fmt.Errorf("invalid threshold")
-		}
-		cfg.Threshold = tHold[2]
-		cfg.ThresholdValue = float32(tVal)
-		if cfg.Overlapping {
-			cfg.Func = ThresholdOverlap
-		} else {
-			cfg.Func = Threshold
-		}
-		return cfg, nil
+// checkNeeds returns an error if config lacks the field named by
+// config.Needs.
+func checkNeeds(config Config) error {
+	missing := false
+	switch config.Needs {
+	case "Normals":
+		missing = config.Normals == nil
+	case "Calibration":
+		missing = config.Calibration == nil
+	case "Baseline":
+		missing = config.Baseline == nil
+	case "Baseline.WetDay":
+		missing = config.Baseline == nil || config.Baseline.WetDay == 0
 	}
-
-	return cfg, fmt.Errorf("unknown reduction")
+	if missing {
+		return fmt.Errorf("%s needs %s", config.Name, config.Needs)
+	}
+	return nil
 }
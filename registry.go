@@ -0,0 +1,107 @@
+package reduce
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+
+	"gitlab.com/bnoon/griddata/params"
+)
+
+// Factory builds the Config of a reduction from the element requesting
+// it. Factories usually start from NewConfig(elem) and set Func and any
+// parameters parsed from elem.ReduceDef.
+type Factory func(elem params.Element) (Config, error)
+
+// Reduction describes a registered reduction. Pattern is nil for
+// reductions registered by exact name; for pattern reductions Name is
+// the source of the pattern.
+type Reduction struct {
+	Name        string
+	Pattern     *regexp.Regexp
+	Description string
+	Factory     Factory
+}
+
+var (
+	registryMu sync.RWMutex
+	byName     = map[string]Reduction{}
+	byPattern  []Reduction
+)
+
+// Register makes the reduction name available to Setup. It panics if
+// name is already registered, so it is meant to be called from init.
+func Register(name, description string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if factory == nil {
+		panic("reduce: Register factory is nil")
+	}
+	if _, dup := byName[name]; dup {
+		panic("reduce: Register called twice for " + name)
+	}
+	byName[name] = Reduction{
+		Name:        name,
+		Description: description,
+		Factory:     factory}
+}
+
+// RegisterPattern makes the reductions whose names match pattern
+// available to Setup. Names registered with Register take precedence;
+// patterns are tried in registration order. The factory typically
+// matches elem.ReduceDef against pattern again to extract parameters.
+func RegisterPattern(pattern *regexp.Regexp, description string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if factory == nil {
+		panic("reduce: RegisterPattern factory is nil")
+	}
+	for _, r := range byPattern {
+		if r.Name == pattern.String() {
+			panic("reduce: RegisterPattern called twice for " + r.Name)
+		}
+	}
+	byPattern = append(byPattern, Reduction{
+		Name:        pattern.String(),
+		Pattern:     pattern,
+		Description: description,
+		Factory:     factory})
+}
+
+// Reductions lists the registered reductions, exact names sorted by name
+// followed by patterns in the order they are tried.
+func Reductions() []Reduction {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	list := make([]Reduction, 0, len(byName)+len(byPattern))
+	for _, r := range byName {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return append(list, byPattern...)
+}
+
+// lookup returns the reduction registered for name.
+func lookup(name string) (Reduction, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	if r, ok := byName[name]; ok {
+		return r, nil
+	}
+	for _, r := range byPattern {
+		if r.Pattern.MatchString(name) {
+			return r, nil
+		}
+	}
+	return Reduction{}, fmt.Errorf("unknown reduction")
+}
+
+// funcFactory returns a Factory running fn.
+func funcFactory(fn Func) Factory {
+	return func(elem params.Element) (Config, error) {
+		cfg := NewConfig(elem)
+		cfg.Func = fn
+		return cfg, nil
+	}
+}
@@ -0,0 +1,56 @@
+package reduce
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
+)
+
+// scale_pattern is registered once per test binary, the registry
+// panics on duplicates when tests are run more than once.
+var scale_pattern *regexp.Regexp = regexp.MustCompile(`^scale_(\d+)$`)
+
+func init() {
+	RegisterPattern(scale_pattern, "test reduction",
+		func(elem params.Element) (Config, error) {
+			cfg := NewConfig(elem)
+			cfg.Func = func(ctx context.Context, config Config,
+				drc datechan.DateRangeChannel,
+				inData, outData chan griddata.DataChunk) error {
+				close(outData)
+				return nil
+			}
+			return cfg, nil
+		})
+}
+
+func TestRegisterPattern(t *testing.T) {
+	assert := assert.New(t)
+
+	var elem params.Element
+	jsonBlob := []byte(`{"vX":4, "interval":[0,0,4], "duration":4, "reduce":"scale_10"}`)
+	err := json.Unmarshal(jsonBlob, &elem)
+	assert.Nil(err)
+
+	cfg, err := Setup(elem)
+	assert.Nil(err)
+	assert.Equal("scale_10", cfg.Name)
+	assert.NotNil(cfg.Func)
+
+	elem.ReduceDef = "scale_x"
+	_, err = Setup(elem)
+	assert.NotNil(err)
+
+	var names []string
+	for _, r := range Reductions() {
+		names = append(names, r.Name)
+	}
+	assert.Contains(names, "mean")
+	assert.Contains(names, scale_pattern.String())
+}
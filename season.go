@@ -0,0 +1,219 @@
+package reduce
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
+)
+
+var season_pattern *regexp.Regexp = regexp.MustCompile(`^(gsl|gsf|ffp)(?:_([-+]?\d*\.?\d*)_(\d+))?(_sh)?$`)
+
+func init() {
+	RegisterPattern(season_pattern,
+		"growing season length (gsl, as ETCCDI GSL with 5 °C and 6 days by default), freeze-free growing season (gsf) or longest frost-free period (ffp) for a threshold and run length, e.g. gsf_32_1; _sh splits the year on January 1",
+		func(elem params.Element) (Config, error) {
+			cfg, _ := funcFactory(GrowingSeason)(elem)
+			cfg.NewAccumulator = newSeasonAcc
+			m := season_pattern.FindStringSubmatch(elem.ReduceDef)
+			cfg.ThresholdType = m[1]
+			cfg.ThresholdValue, cfg.MinRun = seasonBase, seasonRun
+			if m[2] != "" {
+				tVal, err := strconv.ParseFloat(m[2], 32)
+				if err != nil {
+					return cfg, fmt.Errorf("invalid threshold")
+				}
+				minRun, err := strconv.Atoi(m[3])
+				if err != nil || minRun < 1 {
+					return cfg, fmt.Errorf("invalid run length")
+				}
+				cfg.ThresholdValue, cfg.MinRun = float32(tVal), minRun
+			} else if m[1] != "gsl" {
+				return cfg, fmt.Errorf("invalid threshold")
+			}
+			if m[4] != "" {
+				cfg.Split = []int{1, 1}
+			}
+			return cfg, nil
+		})
+}
+
+const (
+	// seasonBase is the temperature (°C) of the ETCCDI growing season.
+	seasonBase = 5
+	// seasonRun is the number of days above or below seasonBase that
+	// start or end the ETCCDI growing season.
+	seasonRun = 6
+)
+
+// seasonAcc tracks the runs of each grid cell around the threshold of a
+// season reduction, see GrowingSeason. Offsets are from the start of the
+// range, start and end are -1 until found.
+type seasonAcc struct {
+	config     Config
+	split      int
+	first      int
+	start, end []int
+	run        []int
+	longest    []int
+	late       bool
+	cnt        []int
+}
+
+func newSeasonAcc(config Config) Accumulator {
+	split := []int{7, 1}
+	if len(config.Split) == 2 {
+		split = config.Split
+	}
+	return &seasonAcc{config: config, split: 100*split[0] + split[1], first: -1}
+}
+
+// isLate returns whether ymd is on or after the split date, in the year
+// starting at the first date of the range.
+func (a *seasonAcc) isLate(ymd []int) bool {
+	if len(ymd) < 3 {
+		return false
+	}
+	md := 100*ymd[1] + ymd[2]
+	if a.first < 0 {
+		a.first = md
+	}
+	return (md-a.first+1300)%1300 >= (a.split-a.first+1300)%1300
+}
+
+func (a *seasonAcc) Add(dr datechan.DateIdxRange, dc griddata.DataChunk) {
+	if a.start == nil {
+		n := len(dc.Data)
+		a.start, a.end = make([]int, n), make([]int, n)
+		a.run, a.longest = make([]int, n), make([]int, n)
+		a.cnt = make([]int, n)
+		for idx := range a.start {
+			a.start[idx], a.end[idx] = -1, -1
+		}
+	}
+	off := int(offsetIn(dr, dc.Date))
+	var late bool
+	if a.config.ThresholdType != "ffp" {
+		late = a.isLate(a.config.Calendar.YItoYMD(dc.Date))
+	}
+	split := late && !a.late
+	a.late = late
+
+	t, minRun := a.config.ThresholdValue, a.config.MinRun
+	for idx, v := range dc.Data {
+		if v == v {
+			a.cnt[idx]++
+		}
+		switch a.config.ThresholdType {
+		case "gsl":
+			switch {
+			case a.start[idx] < 0:
+				a.count(idx, v > t)
+				if a.run[idx] == minRun {
+					a.start[idx] = off - minRun + 1
+					a.run[idx] = 0
+				}
+			case a.end[idx] < 0 && late:
+				a.count(idx, v < t)
+				if a.run[idx] == minRun {
+					a.end[idx] = off - minRun + 1
+				}
+			}
+		case "gsf":
+			if split {
+				a.run[idx] = 0
+			}
+			a.count(idx, v <= t)
+			switch {
+			case a.run[idx] < minRun:
+			case !late:
+				a.start[idx] = off
+			case a.end[idx] < 0:
+				a.end[idx] = off - minRun + 1
+			}
+		case "ffp":
+			a.count(idx, v <= t)
+			if a.run[idx] == minRun {
+				if gap := off - minRun - a.start[idx]; gap > a.longest[idx] {
+					a.longest[idx] = gap
+				}
+			}
+			if a.run[idx] >= minRun {
+				a.start[idx] = off
+			}
+		}
+	}
+}
+
+// count extends the run of cell idx if ok, ends it otherwise.
+func (a *seasonAcc) count(idx int, ok bool) {
+	if ok {
+		a.run[idx]++
+	} else {
+		a.run[idx] = 0
+	}
+}
+
+func (a *seasonAcc) Emit(dr datechan.DateIdxRange) []float32 {
+	nan := float32(math.NaN())
+	expCnt := dr.Len()
+	res := make([]float32, len(a.start))
+	for idx, start := range a.start {
+		end := a.end[idx]
+		if end < 0 {
+			end = expCnt
+		}
+		switch {
+		case expCnt-a.cnt[idx] > a.config.MaxMissing:
+			res[idx] = nan
+		case a.config.ThresholdType == "gsl" && start < 0:
+			res[idx] = 0
+		case a.config.ThresholdType == "gsl":
+			res[idx] = float32(end - start)
+		case a.config.ThresholdType == "gsf":
+			res[idx] = float32(end - start - 1)
+		default:
+			longest := a.longest[idx]
+			if gap := expCnt - 1 - start; gap > longest {
+				longest = gap
+			}
+			res[idx] = float32(longest)
+		}
+	}
+	return res
+}
+
+func (a *seasonAcc) Reset() {
+	a.first = -1
+	a.late = false
+	a.start, a.end = nil, nil
+	a.run, a.longest = nil, nil
+	a.cnt = nil
+}
+
+// GrowingSeason returns the length in days of a season of each grid cell
+// over each date range, a year starting in January, or in July for the
+// southern hemisphere ("_sh"), with config.Split the month and day
+// between spring and fall, July 1 or January 1 ("_sh") by default. A run
+// is config.MinRun days beyond config.ThresholdValue, and a missing
+// value ends the current run.
+//
+// "gsl" is the ETCCDI growing season length: the days from the first run
+// above the threshold to the first run below it on or after the split,
+// or to the end of the range, 0 without a start. "gsf" is the freeze-free
+// season: the days after the last spring run at or below the threshold
+// and before the first fall one, runs not spanning the split. "ffp" is
+// the longest frost-free period: the most days between runs at or below
+// the threshold, or the ends of the range.
+func GrowingSeason(ctx context.Context,
+	config Config,
+	drc datechan.DateRangeChannel,
+	inData, outData chan griddata.DataChunk) error {
+
+	return Accumulate(ctx, config, newSeasonAcc(config), drc, inData, outData)
+}
@@ -0,0 +1,89 @@
+package reduce
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
+)
+
+func TestGrowingSeason(t *testing.T) {
+	assert := assert.New(t)
+	cal := &datechan.Gregorian{}
+	ctx := context.Background()
+
+	// cell 0 freezes from January to March, on April 20 and from
+	// October 10; cell 1 is 10 from October to March and 0 otherwise
+	var days []griddata.DataChunk
+	for day := time.Date(1999, 7, 1, 0, 0, 0, 0, time.UTC); day.Year() <= 2000; day = day.AddDate(0, 0, 1) {
+		d := []int{day.Year(), int(day.Month()), day.Day()}
+		data := []float32{50, 0}
+		if d[1] <= 3 || (d[1] == 4 && d[2] == 20) || (d[1] == 10 && d[2] >= 10) || d[1] > 10 {
+			data[0] = 30
+		}
+		if d[1] <= 3 || d[1] >= 10 {
+			data[1] = 10
+		}
+		days = append(days, griddata.DataChunk{Date: cal.YMDtoYI(d), Data: data})
+	}
+
+	for _, tc := range []struct {
+		name     string
+		month    int
+		expected []float32
+	}{
+		{"gsf_32_1", 12, []float32{172, 0}},
+		{"gsf_32_2", 12, []float32{192, 0}},
+		{"ffp_32_2", 12, []float32{192, 0}},
+		{"gsl_32_6", 12, []float32{192, 0}},
+		{"gsl_32_6_sh", 6, []float32{184, 0}},
+		{"gsl", 12, []float32{366, 182}},
+		{"gsl_sh", 6, []float32{366, 183}},
+	} {
+		var elem params.Element
+		jsonBlob := []byte(`{"vX":4, "interval":[1], "duration":1, "reduce":"` + tc.name + `"}`)
+		err := json.Unmarshal(jsonBlob, &elem)
+		assert.Nil(err)
+		cfg, err := Setup(elem)
+		assert.Nil(err, tc.name)
+
+		drCfg := datechan.IDconfig{
+			Interval:      elem.DateIterConfig.Interval,
+			Duration:      elem.DateIterConfig.Duration,
+			Sdate:         []int{2000, tc.month},
+			Edate:         []int{2000, tc.month},
+			Calendar:      cal,
+			InResolution:  3,
+			OutResolution: 3,
+		}
+		drCfg.Validate()
+		drc := datechan.New(ctx, drCfg)
+
+		inData := make(chan griddata.DataChunk, len(days))
+		outData := make(chan griddata.DataChunk, 0)
+		for _, dc := range days {
+			inData <- dc
+		}
+		close(inData)
+		go func() {
+			err := cfg.Func(ctx, cfg, drc, inData, outData)
+			assert.Nil(err)
+		}()
+
+		d, ok := <-outData
+		assert.True(ok)
+		assert.Equal(tc.expected, d.Data, tc.name)
+		_, ok = <-outData
+		assert.False(ok)
+	}
+
+	for _, name := range []string{"gsf", "ffp_sh", "gsl_5_0"} {
+		_, err := Setup(params.Element{ReduceDef: name})
+		assert.NotNil(err, name)
+	}
+}
@@ -0,0 +1,137 @@
+package reduce
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
+)
+
+var (
+	run_pattern   *regexp.Regexp = regexp.MustCompile(`^(run|runb)` + thresholdOps + `$`)
+	event_pattern *regexp.Regexp = regexp.MustCompile(`^(evt|evtb)` + thresholdOps + `_(\d+)$`)
+)
+
+func init() {
+	RegisterPattern(run_pattern,
+		"longest run of values meeting a threshold, e.g. run_lt_0.01; runb bridges missing values",
+		thresholdFactory(run_pattern, newSpellAcc))
+	RegisterPattern(event_pattern,
+		"number of runs of at least n values meeting a threshold, e.g. evt_gt_95_3; evtb bridges missing values",
+		func(elem params.Element) (Config, error) {
+			cfg, err := thresholdFactory(event_pattern, newSpellAcc)(elem)
+			if err != nil {
+				return cfg, err
+			}
+			m := event_pattern.FindStringSubmatch(elem.ReduceDef)
+			minRun, err := strconv.Atoi(m[len(m)-1])
+			if err != nil || minRun < 1 {
+				return cfg, fmt.Errorf("invalid run length")
+			}
+			cfg.MinRun = minRun
+			return cfg, nil
+		})
+}
+
+// runState tracks the current and longest run of consecutive
+// observations meeting a threshold in one grid cell, the number of runs
+// that reached minRun observations and the days in those runs.
+type runState struct {
+	cur, longest, events, days int
+}
+
+func (r *runState) add(ok bool, minRun int) {
+	if ok {
+		r.cur++
+		if r.cur > r.longest {
+			r.longest = r.cur
+		}
+		if r.cur == minRun {
+			r.events++
+			r.days += minRun
+		} else if r.cur > minRun {
+			r.days++
+		}
+	} else {
+		r.cur = 0
+	}
+}
+
+// runResult converts the run states to the output of a spell reduction:
+// the number of runs of at least MinRun observations for "evt" and
+// "evtb", the observations in those runs for "spell", otherwise the
+// length of the longest run. Cells missing more
+// than MaxMissing of the expCnt expected values are NaN.
+func runResult(config Config, runs []runState, cnt []int, expCnt int) []float32 {
+	nan := float32(math.NaN())
+	events := config.ThresholdType == "evt" || config.ThresholdType == "evtb"
+	res := make([]float32, len(runs))
+	for idx := range runs {
+		switch {
+		case expCnt-cnt[idx] > config.MaxMissing:
+			res[idx] = nan
+		case events:
+			res[idx] = float32(runs[idx].events)
+		case config.ThresholdType == "spell":
+			res[idx] = float32(runs[idx].days)
+		default:
+			res[idx] = float32(runs[idx].longest)
+		}
+	}
+	return res
+}
+
+// spellAcc keeps the run states of each cell and the offset of the last
+// observation, to find absent dates. A missing or absent value ends the
+// run unless runs are bridged, and counts toward MaxMissing either way.
+// Runs cannot be taken back out, so the driver rebuilds it for
+// overlapping ranges.
+type spellAcc struct {
+	config Config
+	test   func(float32) bool
+	bridge bool
+	runs   []runState
+	cnt    []int
+	last   float32
+}
+
+func newSpellAcc(config Config) Accumulator {
+	return &spellAcc{
+		config: config,
+		test:   thresholdFunc(config),
+		bridge: config.ThresholdType == "runb" || config.ThresholdType == "evtb"}
+}
+
+func (a *spellAcc) Add(dr datechan.DateIdxRange, dc griddata.DataChunk) {
+	off := offsetIn(dr, dc.Date)
+	if a.runs == nil {
+		a.runs = make([]runState, len(dc.Data))
+		a.cnt = make([]int, len(dc.Data))
+	} else if off > a.last+1 && !a.bridge {
+		for idx := range a.runs {
+			a.runs[idx].add(false, a.config.MinRun)
+		}
+	}
+	a.last = off
+	for idx, v := range dc.Data {
+		if v == v {
+			a.cnt[idx]++
+			a.runs[idx].add(a.test(v), a.config.MinRun)
+		} else if !a.bridge {
+			a.runs[idx].add(false, a.config.MinRun)
+		}
+	}
+}
+
+func (a *spellAcc) Emit(dr datechan.DateIdxRange) []float32 {
+	return runResult(a.config, a.runs, a.cnt, dr.Len())
+}
+
+func (a *spellAcc) Reset() {
+	a.runs = nil
+	a.cnt = nil
+}
@@ -0,0 +1,114 @@
+package reduce
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
+)
+
+func TestSpellMissing(t *testing.T) {
+	assert := assert.New(t)
+	cal := &datechan.Gregorian{}
+	ctx := context.Background()
+	nan := float32(math.NaN())
+
+	days := [][]float32{
+		{0, 0, nan},
+		{0, nan, nan},
+		{1, 0, nan},
+		{0, 0, nan},
+		{0, 0, 0},
+		{0, 0, 0},
+		{1, nan, 0},
+		{0, 0, 0},
+	}
+
+	for reduce, exp := range map[string][]float32{
+		"run_lt_0.01":    {3, 4, nan},
+		"runb_lt_0.01":   {3, 6, nan},
+		"evt_lt_0.01_2":  {2, 1, nan},
+		"evtb_lt_0.01_3": {1, 1, nan},
+	} {
+		var elem params.Element
+		jsonBlob := []byte(`{"vX":4, "interval":[0,0,8], "duration":8, "reduce":"` + reduce + `","maxMissing":2}`)
+		err := json.Unmarshal(jsonBlob, &elem)
+		assert.Nil(err)
+		cfg, err := Setup(elem)
+		assert.Nil(err)
+
+		drCfg := datechan.IDconfig{
+			Interval:      elem.DateIterConfig.Interval,
+			Duration:      elem.DateIterConfig.Duration,
+			Sdate:         []int{2000, 1, 8},
+			Edate:         []int{2000, 1, 8},
+			Calendar:      cal,
+			InResolution:  3,
+			OutResolution: 3,
+		}
+		drCfg.Validate()
+		drc := datechan.New(ctx, drCfg)
+
+		inData := make(chan griddata.DataChunk, 10)
+		outData := make(chan griddata.DataChunk, 0)
+		for day, data := range days {
+			inData <- griddata.DataChunk{
+				Date: cal.YMDtoYI([]int{2000, 1, day + 1}),
+				Data: data,
+			}
+		}
+		close(inData)
+		go func() {
+			err := cfg.Func(ctx, cfg, drc, inData, outData)
+			assert.Nil(err)
+		}()
+		d, ok := <-outData
+		assert.True(ok)
+		assert.Equal(exp[:2], d.Data[:2], reduce)
+		assert.False(d.Data[2] == d.Data[2], reduce)
+	}
+}
+
+func TestSpellAbsentDay(t *testing.T) {
+	// January 3 is absent
+	days := [][]float32{{1}, {1}, nil, {1}, {1}}
+	for reduce, exp := range map[string]float32{
+		"run_gt_0":  2,
+		"runb_gt_0": 4,
+	} {
+		res := runDaily(t, `{"vX":4, "interval":[0,0,5], "duration":5, "reduce":"`+reduce+`","maxMissing":1}`,
+			[]int{2000, 1, 5}, []int{2000, 1, 5}, days)
+		if assert.Len(t, res, 1, reduce) {
+			assertData(t, []float32{exp}, res[0], reduce)
+		}
+	}
+}
+
+func TestEventAbsentDay(t *testing.T) {
+	// January 3 is absent from a candidate four day event
+	days := [][]float32{{1}, {1}, nil, {1}, {1}}
+	for reduce, exp := range map[string]float32{
+		"evt_gt_0_4":  0,
+		"evt_gt_0_2":  2,
+		"evtb_gt_0_4": 1,
+	} {
+		res := runDaily(t, `{"vX":4, "interval":[0,0,5], "duration":5, "reduce":"`+reduce+`","maxMissing":1}`,
+			[]int{2000, 1, 5}, []int{2000, 1, 5}, days)
+		if assert.Len(t, res, 1, reduce) {
+			assertData(t, []float32{exp}, res[0], reduce)
+		}
+	}
+
+	// overlapping four day windows ending January 4 and 5
+	res := runDaily(t, `{"vX":4, "interval":[0,0,1], "duration":4, "reduce":"evt_gt_0_2","maxMissing":1}`,
+		[]int{2000, 1, 4}, []int{2000, 1, 5}, days)
+	if assert.Len(t, res, 2) {
+		assertData(t, []float32{1}, res[0], "Jan 4")
+		assertData(t, []float32{1}, res[1], "Jan 5")
+	}
+}
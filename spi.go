@@ -0,0 +1,315 @@
+package reduce
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+)
+
+func init() {
+	Register("spi",
+		"standardized precipitation index of the sum, from a gamma distribution; needs Config.Calibration",
+		funcFactory(SPI))
+	Register("spei",
+		"standardized precipitation evapotranspiration index of the sum of a water balance, e.g. precipitation less PET, from a log-logistic distribution; needs Config.Calibration",
+		funcFactory(SPI))
+}
+
+// spiLimit bounds the standardized indices, beyond which the fitted
+// distributions say little.
+const spiLimit = 3.09
+
+// spiMinFit is the number of calibration values needed for a fit.
+const spiMinFit = 3
+
+// distribution is a fitted cumulative distribution function.
+type distribution interface {
+	cdf(x float64) float64
+}
+
+// gammaDist is a gamma distribution of shape alpha and scale beta, mixed
+// with a probability q of zero.
+type gammaDist struct {
+	q, alpha, beta float64
+}
+
+func (d gammaDist) cdf(x float64) float64 {
+	if x <= 0 {
+		return d.q
+	}
+	return d.q + (1-d.q)*gammaP(d.alpha, x/d.beta)
+}
+
+// fitGamma fits a gamma distribution to the positive values of x by the
+// maximum likelihood approximation of Thom (1958), the probability of
+// zero being the fraction of the other values. It returns nil with fewer
+// than spiMinFit positive values, or if they are all the same.
+func fitGamma(x []float64) distribution {
+	var sum, sumLog float64
+	n := 0
+	for _, v := range x {
+		if v > 0 {
+			sum += v
+			sumLog += math.Log(v)
+			n++
+		}
+	}
+	if n < spiMinFit {
+		return nil
+	}
+	mean := sum / float64(n)
+	a := math.Log(mean) - sumLog/float64(n)
+	if a <= 0 {
+		return nil
+	}
+	alpha := (1 + math.Sqrt(1+4*a/3)) / (4 * a)
+	return gammaDist{
+		q:     float64(len(x)-n) / float64(len(x)),
+		alpha: alpha,
+		beta:  mean / alpha}
+}
+
+// gammaP is the regularized lower incomplete gamma function P(a, x), by
+// its series for x < a+1 and its continued fraction otherwise.
+func gammaP(a, x float64) float64 {
+	const (
+		eps  = 1e-12
+		tiny = 1e-300
+	)
+	if x <= 0 {
+		return 0
+	}
+	lg, _ := math.Lgamma(a)
+	scale := math.Exp(-x + a*math.Log(x) - lg)
+	if x < a+1 {
+		del := 1 / a
+		sum := del
+		for n := 1; n < 500; n++ {
+			del *= x / (a + float64(n))
+			sum += del
+			if math.Abs(del) < math.Abs(sum)*eps {
+				break
+			}
+		}
+		return sum * scale
+	}
+	b := x + 1 - a
+	c := 1 / tiny
+	d := 1 / b
+	h := d
+	for i := 1; i < 500; i++ {
+		an := -float64(i) * (float64(i) - a)
+		b += 2
+		d = an*d + b
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = b + an/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		del := d * c
+		h *= del
+		if math.Abs(del-1) < eps {
+			break
+		}
+	}
+	return 1 - scale*h
+}
+
+// logLogisticDist is a three parameter log-logistic distribution of
+// scale alpha, shape beta and origin gamma.
+type logLogisticDist struct {
+	alpha, beta, gamma float64
+}
+
+func (d logLogisticDist) cdf(x float64) float64 {
+	if x <= d.gamma {
+		return 0
+	}
+	return 1 / (1 + math.Pow(d.alpha/(x-d.gamma), d.beta))
+}
+
+// fitLogLogistic fits a log-logistic distribution to x by unbiased
+// probability weighted moments, as Vicente-Serrano et al. (2010) do for
+// the SPEI. It returns nil with fewer than spiMinFit values or a shape
+// of 1 or less.
+func fitLogLogistic(x []float64) distribution {
+	n := len(x)
+	if n < spiMinFit {
+		return nil
+	}
+	sorted := append([]float64(nil), x...)
+	sort.Float64s(sorted)
+	var w [3]float64
+	for i, v := range sorted {
+		f := (float64(i+1) - 0.35) / float64(n)
+		for s := range w {
+			w[s] += math.Pow(1-f, float64(s)) * v
+		}
+	}
+	for s := range w {
+		w[s] /= float64(n)
+	}
+	beta := (2*w[1] - w[0]) / (6*w[1] - w[0] - 6*w[2])
+	if !(beta > 1) {
+		return nil
+	}
+	g := math.Gamma(1+1/beta) * math.Gamma(1-1/beta)
+	alpha := (w[0] - 2*w[1]) * beta / g
+	return logLogisticDist{
+		alpha: alpha,
+		beta:  beta,
+		gamma: w[0] - alpha*g}
+}
+
+// standardize returns the standard normal deviate of the probability p,
+// bounded by spiLimit.
+func standardize(p float64) float32 {
+	z := math.Sqrt2 * math.Erfinv(2*p-1)
+	return float32(math.Max(-spiLimit, math.Min(spiLimit, z)))
+}
+
+// Calibration holds the sums of a calibration period, e.g. 1981-2010,
+// to which the standardized indices fit a distribution per cell and
+// position in the year, see Load. The sums are those of ranges like the
+// ones of the index, e.g. the "sum" output of the same date iteration
+// over the calibration years, keyed by the month and day of their date.
+//
+// A loaded Calibration may be shared by concurrent reductions.
+type Calibration struct {
+	samples map[normalKey][][]float32
+
+	// mu guards fits, the cache of the distributions of each position.
+	mu   sync.Mutex
+	fits map[calibrationKey][]distribution
+}
+
+// calibrationKey identifies the fits of a position for an index.
+type calibrationKey struct {
+	normalKey
+	spei bool
+}
+
+// Load reads the sums of the calibration period, dated in cal, from in
+// until it is closed.
+func (c *Calibration) Load(ctx context.Context, cal datechan.Calendar, in chan griddata.DataChunk) error {
+	if cal == nil {
+		return fmt.Errorf("calibration needs a calendar")
+	}
+	if c.samples == nil {
+		c.samples = make(map[normalKey][][]float32)
+	}
+	c.mu.Lock()
+	c.fits = nil
+	c.mu.Unlock()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case dc, ok := <-in:
+			if !ok {
+				return nil
+			}
+			k := ymdKey(cal.YItoYMD(dc.Date), dc.Offset)
+			c.samples[k] = append(c.samples[k], dc.Data)
+		}
+	}
+}
+
+// fit returns the distributions of the cells of the position nk, nil
+// for cells that could not be fit.
+func (c *Calibration) fit(nk normalKey, spei bool) []distribution {
+	k := calibrationKey{nk, spei}
+	c.mu.Lock()
+	dists, ok := c.fits[k]
+	c.mu.Unlock()
+	if ok {
+		return dists
+	}
+	samples := c.samples[nk]
+	if len(samples) > 0 {
+		dists = make([]distribution, len(samples[0]))
+		x := make([]float64, 0, len(samples))
+		for idx := range dists {
+			x = x[:0]
+			for _, data := range samples {
+				if v := data[idx]; v == v {
+					x = append(x, float64(v))
+				}
+			}
+			if spei {
+				dists[idx] = fitLogLogistic(x)
+			} else {
+				dists[idx] = fitGamma(x)
+			}
+		}
+	}
+	c.mu.Lock()
+	if c.fits == nil {
+		c.fits = make(map[calibrationKey][]distribution)
+	}
+	c.fits[k] = dists
+	c.mu.Unlock()
+	return dists
+}
+
+// spiAcc standardizes the sums of sumAcc by the fits of the calibration.
+type spiAcc struct {
+	sumAcc
+	spei   bool
+	offset int
+}
+
+func newSPIAcc(config Config) *spiAcc {
+	return &spiAcc{sumAcc: sumAcc{config: config}, spei: config.Name == "spei"}
+}
+
+func (a *spiAcc) Add(dr datechan.DateIdxRange, dc griddata.DataChunk) {
+	a.offset = dc.Offset
+	a.sumAcc.Add(dr, dc)
+}
+
+func (a *spiAcc) Emit(dr datechan.DateIdxRange) []float32 {
+	nan := float32(math.NaN())
+	res := a.sumAcc.Emit(dr)
+	k := ymdKey(a.config.Calendar.YItoYMD(dr.Resample(dr.End)), a.offset)
+	dists := a.config.Calibration.fit(k, a.spei)
+	for idx, v := range res {
+		if v != v || idx >= len(dists) || dists[idx] == nil {
+			res[idx] = nan
+		} else {
+			res[idx] = standardize(dists[idx].cdf(float64(v)))
+		}
+	}
+	return res
+}
+
+// SPI returns the standardized precipitation index ("spi") or the
+// standardized precipitation evapotranspiration index ("spei") of the
+// sum of each grid cell over each date range, e.g. 3 month ranges for
+// the SPI-3. The sum is standardized by the distribution of the sums of
+// config.Calibration at the same position in the year, in
+// config.Calendar: a gamma distribution with a probability of zero for
+// the SPI and a log-logistic distribution for the SPEI, whose input is a
+// water balance such as precipitation less potential evapotranspiration.
+//
+// Values are bounded by ±3.09. Cells missing more than MaxMissing values,
+// or whose calibration sums cannot be fit, are NaN.
+func SPI(ctx context.Context,
+	config Config,
+	drc datechan.DateRangeChannel,
+	inData, outData chan griddata.DataChunk) error {
+
+	if config.Calibration == nil {
+		close(outData)
+		return fmt.Errorf("standardized index needs a calibration")
+	}
+	return Accumulate(ctx, config, newSPIAcc(config), drc, inData, outData)
+}
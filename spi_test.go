@@ -0,0 +1,128 @@
+package reduce
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
+)
+
+func TestDistributions(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.InDelta(1-math.Exp(-0.5), gammaP(1, 0.5), 1e-12)
+	assert.InDelta(1-2/math.E, gammaP(2, 1), 1e-12)
+	assert.InDelta(1-61*math.Exp(-10), gammaP(3, 10), 1e-12)
+
+	assert.Equal(float32(0), standardize(0.5))
+	assert.InDelta(1, standardize(0.8413447460685429), 1e-6)
+	assert.Equal(float32(-spiLimit), standardize(0))
+
+	d := fitLogLogistic([]float64{-3, 1, 2, 4, 5, 7, 8, 12, 15, 30})
+	if assert.NotNil(d) {
+		ll := d.(logLogisticDist)
+		assert.InDelta(0.5, d.cdf(ll.gamma+ll.alpha), 1e-12)
+		assert.True(d.cdf(1) < d.cdf(10))
+	}
+	assert.Nil(fitLogLogistic([]float64{1, 2}))
+	assert.Nil(fitGamma([]float64{0, 5, 5, 5}))
+}
+
+func TestSPI(t *testing.T) {
+	assert := assert.New(t)
+	cal := &datechan.Gregorian{}
+	ctx := context.Background()
+
+	// sums of Jan 1-4 in the calibration years
+	sums := [][]float32{{0, 5}, {10, 5}, {20, 5}, {30, 5}, {40, 5}}
+
+	var elem params.Element
+	jsonBlob := []byte(`{"vX":4, "interval":[0,0,4], "duration":4, "reduce":"spi"}`)
+	err := json.Unmarshal(jsonBlob, &elem)
+	assert.Nil(err)
+	cfg, err := Setup(elem)
+	assert.Nil(err)
+
+	cfg.Calibration = &Calibration{}
+	calData := make(chan griddata.DataChunk, 10)
+	for y, data := range sums {
+		calData <- griddata.DataChunk{Date: cal.YMDtoYI([]int{1990 + y, 1, 4}), Data: data}
+	}
+	close(calData)
+	assert.Nil(cfg.Calibration.Load(ctx, cal, calData))
+
+	drCfg := datechan.IDconfig{
+		Interval:      elem.DateIterConfig.Interval,
+		Duration:      elem.DateIterConfig.Duration,
+		Sdate:         []int{2000, 1, 4},
+		Edate:         []int{2000, 1, 4},
+		Calendar:      cal,
+		InResolution:  3,
+		OutResolution: 3,
+	}
+	drCfg.Validate()
+	drc := datechan.New(ctx, drCfg)
+
+	inData := make(chan griddata.DataChunk, 10)
+	outData := make(chan griddata.DataChunk, 0)
+	for day := 1; day <= 4; day++ {
+		inData <- griddata.DataChunk{Date: cal.YMDtoYI([]int{2000, 1, day}), Data: []float32{0, 1}}
+	}
+	close(inData)
+	go func() {
+		err := cfg.Func(ctx, cfg, drc, inData, outData)
+		assert.Nil(err)
+	}()
+
+	d, ok := <-outData
+	assert.True(ok)
+	// the probability of no precipitation is 0.2
+	assert.InDelta(-0.8416212, d.Data[0], 1e-5)
+	// no fit of constant sums
+	assert.True(d.Data[1] != d.Data[1])
+	_, ok = <-outData
+	assert.False(ok)
+
+	cfg, err = Setup(params.Element{ReduceDef: "spei"})
+	assert.Nil(err)
+	outData = make(chan griddata.DataChunk)
+	assert.NotNil(cfg.Func(ctx, cfg, nil, nil, outData))
+}
+
+func TestCalibrationShared(t *testing.T) {
+	assert := assert.New(t)
+	cal := &datechan.Gregorian{}
+	ctx := context.Background()
+
+	calData := make(chan griddata.DataChunk, 10)
+	for y, v := range []float32{10, 20, 30, 40} {
+		d := []int{1990 + y, 1, 4}
+		calData <- griddata.DataChunk{Date: cal.YMDtoYI(d), Data: []float32{v}}
+	}
+	close(calData)
+	c := &Calibration{}
+	assert.Nil(c.Load(ctx, cal, calData))
+
+	// reductions sharing the calibration fill its cache concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dists := c.fit(ymdKey([]int{2000, 1, 4}, 0), false)
+			if assert.Len(dists, 1) {
+				assert.NotNil(dists[0])
+			}
+		}()
+	}
+	wg.Wait()
+
+	// a calibration never loaded has no fits
+	assert.Len((&Calibration{}).fit(ymdKey([]int{2000, 1, 4}, 0), false), 0)
+}
@@ -2,292 +2,181 @@ package reduce
 
 import (
 	"context"
+	"fmt"
 	"math"
-
-	alog "github.com/apex/log"
+	"regexp"
+	"strconv"
 
 	"gitlab.com/bnoon/datechan"
 	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
 )
 
-func Sum(ctx context.Context,
-	config Config,
-	drc datechan.DateRangeChannel,
-	inData, outData chan griddata.DataChunk) error {
-
-	defer close(outData)
-
-	nan := float32(math.NaN())
-
-	var (
-		dr             datechan.DateIdxRange
-		last_start     datechan.DateIdx
-		inDC, inDC1    griddata.DataChunk
-		dr_ok, inDC_ok bool
-		obsCnt         int
-		sum            []float32
-		cnt            []int
-	)
-
-	nextRange := func() error {
-		if obsCnt > 0 {
-			expCnt := dr.Len()
-			res := make([]float32, len(sum))
-			for idx, v := range sum {
-				if expCnt-cnt[idx] > config.MaxMissing {
-					res[idx] = nan
-				} else {
-					res[idx] = v
-				}
+var maxsum_pattern *regexp.Regexp = regexp.MustCompile(`^maxsum_(\d+)$`)
+
+func init() {
+	Register("sum", "sum of the valid values", AccumulatorFactory(newSumAcc))
+	RegisterPattern(maxsum_pattern,
+		"largest sum of n consecutive values, e.g. maxsum_5 (Rx5day)",
+		func(elem params.Element) (Config, error) {
+			cfg, _ := AccumulatorFactory(newMaxSumAcc)(elem)
+			m := maxsum_pattern.FindStringSubmatch(elem.ReduceDef)
+			n, err := strconv.Atoi(m[1])
+			if err != nil || n < 1 {
+				return cfg, fmt.Errorf("invalid run length")
 			}
+			cfg.MinRun = n
+			return cfg, nil
+		})
+}
 
-			last_start = dr.Start.Copy()
-			outDC := griddata.DataChunk{
-				Date:   dr.Resample(inDC1.Date),
-				Offset: inDC1.Offset,
-				Length: inDC1.Length,
-				Data:   res}
-
-			select {
-			case outData <- outDC:
-			case <-ctx.Done():
-				return ctx.Err()
-			}
-		}
-
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case dr, dr_ok = <-drc:
-		}
+// sumAcc accumulates the sum of the valid values of each grid cell,
+// transformed by fn if it is not nil, and their count.
+type sumAcc struct {
+	config Config
+	fn     func(float32) float32
+	sum    []float32
+	cnt    []int
+}
 
-		if !(dr_ok && dr.Start.Equal(last_start)) {
-			sum = nil
-			obsCnt = 0
-		}
-		return nil
-	}
+func newSumAcc(config Config) Accumulator {
+	return &sumAcc{config: config}
+}
 
-	if err := nextRange(); err != nil {
-		return err
+func (a *sumAcc) Add(dr datechan.DateIdxRange, dc griddata.DataChunk) {
+	if a.sum == nil {
+		a.sum = make([]float32, len(dc.Data))
+		a.cnt = make([]int, len(dc.Data))
 	}
-
-dataLoop:
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case inDC, inDC_ok = <-inData:
-		}
-		if !inDC_ok {
-			break
-		}
-
-		if inDC.Date.Less(dr.Start) {
-			alog.Debugf("skip %s < %s", inDC.Date.Key(), dr.Start.Key())
-			continue
-		}
-		if inDC.Date.Less(dr.End) || inDC.Date.Equal(dr.End) {
-			// alog.Debugf("add %s",inDC.Date.Key())
-			if sum == nil {
-				sum = make([]float32, len(inDC.Data))
-				cnt = make([]int, len(inDC.Data))
-			}
-			for idx, v := range inDC.Data {
-				if v == v {
-					sum[idx] += v
-					cnt[idx]++
-				}
-			}
-			obsCnt++
-			inDC1 = inDC
-		}
-		if !inDC.Date.Less(dr.End) {
-			// alog.Debugf("done? %d %s >= %s",obsCnt, inDC.Date.Key(), dr.End.Key())
-			for {
-				if err := nextRange(); err != nil {
-					return err
-				}
-				if !dr_ok {
-					break dataLoop
-				}
-				if !dr.End.Less(inDC.Date) {
-					break
-				}
-				alog.Debugf("skip+ %s >= %s", inDC.Date.Key(), dr.End.Key())
+	for idx, v := range dc.Data {
+		if v == v {
+			if a.fn != nil {
+				v = a.fn(v)
 			}
+			a.sum[idx] += v
+			a.cnt[idx]++
 		}
 	}
+}
 
-	if err := nextRange(); err != nil {
-		return err
+func (a *sumAcc) Remove(dc griddata.DataChunk) {
+	for idx, v := range dc.Data {
+		if v == v {
+			if a.fn != nil {
+				v = a.fn(v)
+			}
+			a.sum[idx] -= v
+			a.cnt[idx]--
+		}
 	}
+}
 
-	// drain data channel??
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case inDC, inDC_ok = <-inData:
-			if !inDC_ok {
-				return nil
-			}
+func (a *sumAcc) Emit(dr datechan.DateIdxRange) []float32 {
+	nan := float32(math.NaN())
+	expCnt := dr.Len()
+	res := make([]float32, len(a.sum))
+	for idx, v := range a.sum {
+		if expCnt-a.cnt[idx] > a.config.MaxMissing {
+			res[idx] = nan
+		} else {
+			res[idx] = v
 		}
 	}
+	return res
+}
 
-	return nil
+func (a *sumAcc) Reset() {
+	a.sum = nil
+	a.cnt = nil
 }
 
-func SumOverlap(ctx context.Context,
+func Sum(ctx context.Context,
 	config Config,
 	drc datechan.DateRangeChannel,
 	inData, outData chan griddata.DataChunk) error {
 
-	defer close(outData)
+	config.Overlapping = false
+	return Accumulate(ctx, config, newSumAcc(config), drc, inData, outData)
+}
 
-	nan := float32(math.NaN())
+func SumOverlap(ctx context.Context,
+	config Config,
+	drc datechan.DateRangeChannel,
+	inData, outData chan griddata.DataChunk) error {
 
-	var (
-		dr              datechan.DateIdxRange
-		inDC            griddata.DataChunk
-		dr_ok, inDC_ok  bool
-		obsCnt          int
-		sum             []float32
-		cnt             []int
-		firstDC, lastDC *dataListItem
-	)
+	config.Overlapping = true
+	return Accumulate(ctx, config, newSumAcc(config), drc, inData, outData)
+}
 
-	nextRange := func() error {
-		if obsCnt > 0 {
-			expCnt := dr.Len()
-			res := make([]float32, len(sum))
-			for idx, v := range sum {
-				if expCnt-cnt[idx] > config.MaxMissing {
-					res[idx] = nan
-				} else {
-					res[idx] = v
-				}
-			}
-			outDC := griddata.DataChunk{
-				Date:   dr.Resample(lastDC.data.Date),
-				Offset: lastDC.data.Offset,
-				Length: lastDC.data.Length,
-				Data:   res}
+// maxSumAcc keeps the last MinRun consecutive chunks of the range, the
+// offset of the last one and the largest sum of MinRun consecutive
+// values of each grid cell. Sums with a missing value, or across a date
+// absent from the input, are skipped.
+type maxSumAcc struct {
+	config Config
+	recent [][]float32
+	last   float32
+	max    []float32
+	cnt    []int
+}
 
-			select {
-			case outData <- outDC:
-			case <-ctx.Done():
-				return ctx.Err()
-			}
-		}
+func newMaxSumAcc(config Config) Accumulator {
+	return &maxSumAcc{config: config}
+}
 
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case dr, dr_ok = <-drc:
+func (a *maxSumAcc) Add(dr datechan.DateIdxRange, dc griddata.DataChunk) {
+	if a.max == nil {
+		nan := float32(math.NaN())
+		a.max = make([]float32, len(dc.Data))
+		a.cnt = make([]int, len(dc.Data))
+		for idx := range a.max {
+			a.max[idx] = nan
 		}
-
-		if dr_ok {
-			for firstDC != nil {
-				if firstDC.data.Date.Less(dr.Start) { // no longer in daterange
-					// handle removing data:
-					//   subtract data for sum/mean reduction
-					//   test threshold and adjust count
-					//   min/max, just remove
-					for idx, v := range firstDC.data.Data {
-						if v == v {
-							sum[idx] -= v
-							cnt[idx]--
-						}
-					}
-					obsCnt--
-					firstDC = firstDC.next
-					if firstDC == nil {
-						lastDC = nil
-						sum = nil
-					}
-				} else {
-					break
-				}
-			}
-		} else {
-			// obsCnt is a flag
-			obsCnt = 0
+	}
+	for idx, v := range dc.Data {
+		if v == v {
+			a.cnt[idx]++
 		}
-		return nil
 	}
-
-	if err := nextRange(); err != nil {
-		return err
+	off := offsetIn(dr, dc.Date)
+	if len(a.recent) > 0 && off != a.last+1 {
+		a.recent = nil
 	}
-
-dataLoop:
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case inDC, inDC_ok = <-inData:
-		}
-		if !inDC_ok {
-			break
-		}
-
-		if inDC.Date.Less(dr.Start) {
-			alog.Debugf("skip %s < %s", inDC.Date.Key(), dr.Start.Key())
-			continue
-		}
-		if inDC.Date.Less(dr.End) || inDC.Date.Equal(dr.End) {
-			if sum == nil {
-				sum = make([]float32, len(inDC.Data))
-				cnt = make([]int, len(inDC.Data))
-			}
-			for idx, v := range inDC.Data {
-				if v == v {
-					sum[idx] += v
-					cnt[idx]++
-				}
-			}
-			obsCnt++
-			if firstDC == nil {
-				firstDC = &dataListItem{data: inDC}
-				lastDC = firstDC
-			} else {
-				nextDC := &dataListItem{data: inDC}
-				lastDC.next = nextDC
-				lastDC = nextDC
-			}
+	a.last = off
+	a.recent = append(a.recent, dc.Data)
+	if len(a.recent) > a.config.MinRun {
+		a.recent = a.recent[1:]
+	}
+	if len(a.recent) < a.config.MinRun {
+		return
+	}
+	for idx, m := range a.max {
+		var s float32
+		for _, data := range a.recent {
+			s += data[idx]
 		}
-		if !inDC.Date.Less(dr.End) {
-			for {
-				if err := nextRange(); err != nil {
-					return err
-				}
-				if !dr_ok {
-					break dataLoop
-				}
-				if !dr.End.Less(inDC.Date) {
-					break
-				}
-				alog.Debugf("skip+ %s >= %s", inDC.Date.Key(), dr.End.Key())
-			}
+		if s == s && (m != m || s > m) {
+			a.max[idx] = s
 		}
 	}
+}
 
-	if err := nextRange(); err != nil {
-		return err
-	}
-
-	// drain data channel??
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case inDC, inDC_ok = <-inData:
-			if !inDC_ok {
-				return nil
-			}
+func (a *maxSumAcc) Emit(dr datechan.DateIdxRange) []float32 {
+	nan := float32(math.NaN())
+	expCnt := dr.Len()
+	res := make([]float32, len(a.max))
+	for idx, v := range a.max {
+		if expCnt-a.cnt[idx] > a.config.MaxMissing {
+			res[idx] = nan
+		} else {
+			res[idx] = v
 		}
 	}
+	return res
+}
 
-	return nil
+func (a *maxSumAcc) Reset() {
+	a.recent = nil
+	a.max = nil
+	a.cnt = nil
 }
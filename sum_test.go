@@ -236,3 +236,15 @@ func TestSumMissingMonth(t *testing.T) {
 	assert.Equal(float32(30.), d.Data[1])
 	assert.Equal(float32(31.), d.Data[2])
 }
+
+func TestMaxSumAbsentDay(t *testing.T) {
+	nan := float32(math.NaN())
+
+	// January 3 is absent
+	days := [][]float32{{1, 1}, {2, 2}, nil, {4, 4}, {5, nan}, {1, 1}}
+	res := runDaily(t, `{"vX":4, "interval":[0,0,6], "duration":6, "reduce":"maxsum_3","maxMissing":2}`,
+		[]int{2000, 1, 6}, []int{2000, 1, 6}, days)
+	if assert.Len(t, res, 1) {
+		assertData(t, []float32{10, nan}, res[0], "maxsum_3")
+	}
+}
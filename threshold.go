@@ -2,415 +2,262 @@ package reduce
 
 import (
 	"context"
+	"fmt"
 	"math"
-
-	alog "github.com/apex/log"
+	"regexp"
+	"strconv"
 
 	"gitlab.com/bnoon/datechan"
 	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
 )
 
-func Threshold(ctx context.Context,
-	config Config,
-	drc datechan.DateRangeChannel,
-	inData, outData chan griddata.DataChunk) error {
-
-	defer close(outData)
-
-	nan := float32(math.NaN())
-
-	var (
-		dr             datechan.DateIdxRange
-		last_start     datechan.DateIdx
-		inDC, inDC1    griddata.DataChunk
-		dr_ok, inDC_ok bool
-		obsCnt         int
-		pCnt           []float32
-		cnt            []int
-	)
-
-	nextRange := func() error {
-		if obsCnt > 0 {
-			expCnt := dr.Len()
-			res := make([]float32, len(pCnt))
-			for idx, v := range pCnt {
-				if expCnt-cnt[idx] > config.MaxMissing {
-					res[idx] = nan
-				} else {
-					res[idx] = v
-				}
-			}
-
-			last_start = dr.Start.Copy()
-			outDC := griddata.DataChunk{
-				Date:   dr.Resample(inDC1.Date),
-				Offset: inDC1.Offset,
-				Length: inDC1.Length,
-				Data:   res}
+// thresholdOps is the comparison part of the threshold grammar,
+// "_<op>_<value>" or "_<btw|btx|bth>_<low>_<high>". It adds five
+// submatches, see parseThreshold.
+const thresholdOps = `_(?:(lt|gt|le|ge|eq|ne)_([-+]?\d*\.?\d*)|(btw|btx|bth)_([-+]?\d*\.?\d*)_([-+]?\d*\.?\d*))`
 
-			select {
-			case outData <- outDC:
-			case <-ctx.Done():
-				return ctx.Err()
-			}
-		}
+var threshold_pattern *regexp.Regexp = regexp.MustCompile(`^(cnt|pct|fct)` + thresholdOps + `$`)
 
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case dr, dr_ok = <-drc:
-		}
+func init() {
+	RegisterPattern(threshold_pattern,
+		"number (cnt), percentage (pct) or fraction (fct) of values meeting a threshold, e.g. cnt_gt_90 or pct_btw_32_50",
+		thresholdFactory(threshold_pattern, newThresholdAcc))
+}
 
-		if !(dr_ok && dr.Start.Equal(last_start)) {
-			pCnt = nil
-			obsCnt = 0
+// parseThreshold sets the threshold of cfg from the submatches m of a
+// pattern built as prefix + thresholdOps, m[0] being the prefix.
+func parseThreshold(cfg *Config, m []string) error {
+	cfg.ThresholdType = m[0]
+	if m[1] != "" {
+		tVal, err := strconv.ParseFloat(m[2], 32)
+		if err != nil {
+			return fmt.Errorf("invalid threshold")
 		}
+		cfg.Threshold = m[1]
+		cfg.ThresholdValue = float32(tVal)
 		return nil
 	}
-
-	if err := nextRange(); err != nil {
-		return err
+	tLow, err := strconv.ParseFloat(m[4], 32)
+	if err != nil {
+		return fmt.Errorf("invalid threshold")
+	}
+	tHigh, err := strconv.ParseFloat(m[5], 32)
+	if err != nil || tHigh < tLow {
+		return fmt.Errorf("invalid threshold")
 	}
+	cfg.Threshold = m[3]
+	cfg.ThresholdValue = float32(tLow)
+	cfg.ThresholdUpper = float32(tHigh)
+	return nil
+}
 
-dataLoop:
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case inDC, inDC_ok = <-inData:
-		}
-		if !inDC_ok {
-			break
+// thresholdFactory returns a Factory for reductions named by pattern,
+// which starts with a prefix submatch followed by thresholdOps, computed
+// by the accumulators of newAcc.
+func thresholdFactory(pattern *regexp.Regexp, newAcc func(Config) Accumulator) Factory {
+	return func(elem params.Element) (Config, error) {
+		cfg, _ := AccumulatorFactory(newAcc)(elem)
+		m := pattern.FindStringSubmatch(elem.ReduceDef)
+		if m == nil {
+			return cfg, fmt.Errorf("unknown reduction")
 		}
+		return cfg, parseThreshold(&cfg, m[1:])
+	}
+}
 
-		if inDC.Date.Less(dr.Start) {
-			alog.Debugf("skip %s < %s", inDC.Date.Key(), dr.Start.Key())
-			continue
-		}
-		if inDC.Date.Less(dr.End) || inDC.Date.Equal(dr.End) {
-			// alog.Debugf("add %s",inDC.Date.Key())
-			if pCnt == nil {
-				pCnt = make([]float32, len(inDC.Data))
-				cnt = make([]int, len(inDC.Data))
+// countThreshold adds (delta 1) or removes (delta -1) the observations
+// in data to the per cell counts of valid values, cnt, and of values
+// meeting the threshold, pCnt. The range tests compare against
+// [ThresholdValue, ThresholdUpper]: "btw" includes both ends, "btx"
+// excludes both and "bth" includes only the lower end.
+func countThreshold(config Config, data, pCnt []float32, cnt []int, delta int) {
+	d := float32(delta)
+	switch config.Threshold {
+	case "lt":
+		for idx, v := range data {
+			if v == v {
+				cnt[idx] += delta
+				if v < config.ThresholdValue {
+					pCnt[idx] += d
+				}
 			}
-			switch config.Threshold {
-			case "lt":
-				for idx, v := range inDC.Data {
-					if v == v {
-						cnt[idx]++
-						if v < config.ThresholdValue {
-							pCnt[idx]++
-						}
-					}
+		}
+	case "gt":
+		for idx, v := range data {
+			if v == v {
+				cnt[idx] += delta
+				if v > config.ThresholdValue {
+					pCnt[idx] += d
 				}
-			case "gt":
-				for idx, v := range inDC.Data {
-					if v == v {
-						cnt[idx]++
-						if v > config.ThresholdValue {
-							pCnt[idx]++
-						}
-					}
+			}
+		}
+	case "le":
+		for idx, v := range data {
+			if v == v {
+				cnt[idx] += delta
+				if v <= config.ThresholdValue {
+					pCnt[idx] += d
 				}
-			case "le":
-				for idx, v := range inDC.Data {
-					if v == v {
-						cnt[idx]++
-						if v <= config.ThresholdValue {
-							pCnt[idx]++
-						}
-					}
+			}
+		}
+	case "ge":
+		for idx, v := range data {
+			if v == v {
+				cnt[idx] += delta
+				if v >= config.ThresholdValue {
+					pCnt[idx] += d
 				}
-			case "ge":
-				for idx, v := range inDC.Data {
-					if v == v {
-						cnt[idx]++
-						if v >= config.ThresholdValue {
-							pCnt[idx]++
-						}
-					}
+			}
+		}
+	case "eq":
+		for idx, v := range data {
+			if v == v {
+				cnt[idx] += delta
+				if v == config.ThresholdValue {
+					pCnt[idx] += d
 				}
-			case "eq":
-				for idx, v := range inDC.Data {
-					if v == v {
-						cnt[idx]++
-						if v == config.ThresholdValue {
-							pCnt[idx]++
-						}
-					}
+			}
+		}
+	case "ne":
+		for idx, v := range data {
+			if v == v {
+				cnt[idx] += delta
+				if v != config.ThresholdValue {
+					pCnt[idx] += d
 				}
 			}
-			obsCnt++
-			inDC1 = inDC
 		}
-		if !inDC.Date.Less(dr.End) {
-			// alog.Debugf("done? %d %s >= %s",obsCnt, inDC.Date.Key(), dr.End.Key())
-			for {
-				if err := nextRange(); err != nil {
-					return err
+	case "btw":
+		for idx, v := range data {
+			if v == v {
+				cnt[idx] += delta
+				if v >= config.ThresholdValue && v <= config.ThresholdUpper {
+					pCnt[idx] += d
 				}
-				if !dr_ok {
-					break dataLoop
+			}
+		}
+	case "btx":
+		for idx, v := range data {
+			if v == v {
+				cnt[idx] += delta
+				if v > config.ThresholdValue && v < config.ThresholdUpper {
+					pCnt[idx] += d
 				}
-				if !dr.End.Less(inDC.Date) {
-					break
+			}
+		}
+	case "bth":
+		for idx, v := range data {
+			if v == v {
+				cnt[idx] += delta
+				if v >= config.ThresholdValue && v < config.ThresholdUpper {
+					pCnt[idx] += d
 				}
-				alog.Debugf("skip+ %s >= %s", inDC.Date.Key(), dr.End.Key())
 			}
 		}
 	}
+}
 
-	if err := nextRange(); err != nil {
-		return err
+// thresholdFunc returns the threshold test of config as a function, for
+// reductions that need the outcome of each observation rather than a
+// count.
+func thresholdFunc(config Config) func(float32) bool {
+	t, u := config.ThresholdValue, config.ThresholdUpper
+	switch config.Threshold {
+	case "lt":
+		return func(v float32) bool { return v < t }
+	case "gt":
+		return func(v float32) bool { return v > t }
+	case "le":
+		return func(v float32) bool { return v <= t }
+	case "ge":
+		return func(v float32) bool { return v >= t }
+	case "eq":
+		return func(v float32) bool { return v == t }
+	case "ne":
+		return func(v float32) bool { return v != t }
+	case "btw":
+		return func(v float32) bool { return v >= t && v <= u }
+	case "btx":
+		return func(v float32) bool { return v > t && v < u }
+	case "bth":
+		return func(v float32) bool { return v >= t && v < u }
 	}
+	return func(v float32) bool { return false }
+}
 
-	// drain data channel??
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case inDC, inDC_ok = <-inData:
-			if !inDC_ok {
-				return nil
-			}
+// thresholdResult converts the counts of countThreshold, or the sums of
+// baseAcc, to the output of a threshold reduction: the number of values
+// meeting the threshold ("cnt"), the sum of those values ("sum"), or
+// their percentage ("pct") or fraction ("fct") of the valid values of
+// the cell. Cells missing more than MaxMissing of the expCnt expected
+// values are NaN, as are pct and fct cells with no valid value.
+func thresholdResult(config Config, pCnt []float32, cnt []int, expCnt int) []float32 {
+	nan := float32(math.NaN())
+	res := make([]float32, len(pCnt))
+	for idx, v := range pCnt {
+		switch {
+		case expCnt-cnt[idx] > config.MaxMissing:
+			res[idx] = nan
+		case config.ThresholdType == "cnt" || config.ThresholdType == "sum":
+			res[idx] = v
+		case cnt[idx] == 0:
+			res[idx] = nan
+		case config.ThresholdType == "pct":
+			res[idx] = 100 * v / float32(cnt[idx])
+		default:
+			res[idx] = v / float32(cnt[idx])
 		}
 	}
-
-	return nil
+	return res
 }
 
-func ThresholdOverlap(ctx context.Context,
-	config Config,
-	drc datechan.DateRangeChannel,
-	inData, outData chan griddata.DataChunk) error {
-
-	defer close(outData)
-
-	nan := float32(math.NaN())
-
-	var (
-		dr              datechan.DateIdxRange
-		inDC            griddata.DataChunk
-		dr_ok, inDC_ok  bool
-		obsCnt          int
-		pCnt            []float32
-		cnt             []int
-		firstDC, lastDC *dataListItem
-	)
-
-	nextRange := func() error {
-		if obsCnt > 0 {
-			expCnt := dr.Len()
-			res := make([]float32, len(pCnt))
-			for idx, v := range pCnt {
-				if expCnt-cnt[idx] > config.MaxMissing {
-					res[idx] = nan
-				} else {
-					res[idx] = v
-				}
-			}
-			outDC := griddata.DataChunk{
-				Date:   dr.Resample(lastDC.data.Date),
-				Offset: lastDC.data.Offset,
-				Length: lastDC.data.Length,
-				Data:   res}
-
-			select {
-			case outData <- outDC:
-			case <-ctx.Done():
-				return ctx.Err()
-			}
-		}
+// thresholdAcc keeps the counts of countThreshold.
+type thresholdAcc struct {
+	config Config
+	pCnt   []float32
+	cnt    []int
+}
 
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case dr, dr_ok = <-drc:
-		}
+func newThresholdAcc(config Config) Accumulator {
+	return &thresholdAcc{config: config}
+}
 
-		if dr_ok {
-			for firstDC != nil {
-				if firstDC.data.Date.Less(dr.Start) { // no longer in daterange
-					// handle removing data:
-					//   subtract data for sum/mean reduction
-					//   test threshold and adjust count
-					//   min/max, just remove
-					switch config.Threshold {
-					case "lt":
-						for idx, v := range inDC.Data {
-							if v == v {
-								cnt[idx]++
-								if v >= config.ThresholdValue {
-									pCnt[idx]--
-								}
-							}
-						}
-					case "gt":
-						for idx, v := range inDC.Data {
-							if v == v {
-								cnt[idx]++
-								if v <= config.ThresholdValue {
-									pCnt[idx]--
-								}
-							}
-						}
-					case "le":
-						for idx, v := range inDC.Data {
-							if v == v {
-								cnt[idx]++
-								if v > config.ThresholdValue {
-									pCnt[idx]--
-								}
-							}
-						}
-					case "ge":
-						for idx, v := range inDC.Data {
-							if v == v {
-								cnt[idx]++
-								if v < config.ThresholdValue {
-									pCnt[idx]--
-								}
-							}
-						}
-					case "eq":
-						for idx, v := range inDC.Data {
-							if v == v {
-								cnt[idx]++
-								if v != config.ThresholdValue {
-									pCnt[idx]--
-								}
-							}
-						}
-					}
-					obsCnt--
-					firstDC = firstDC.next
-					if firstDC == nil {
-						lastDC = nil
-						pCnt = nil
-					}
-				} else {
-					break
-				}
-			}
-		} else {
-			// obsCnt is a flag
-			obsCnt = 0
-		}
-		return nil
+func (a *thresholdAcc) Add(dr datechan.DateIdxRange, dc griddata.DataChunk) {
+	if a.pCnt == nil {
+		a.pCnt = make([]float32, len(dc.Data))
+		a.cnt = make([]int, len(dc.Data))
 	}
+	countThreshold(a.config, dc.Data, a.pCnt, a.cnt, 1)
+}
 
-	if err := nextRange(); err != nil {
-		return err
-	}
+func (a *thresholdAcc) Remove(dc griddata.DataChunk) {
+	countThreshold(a.config, dc.Data, a.pCnt, a.cnt, -1)
+}
 
-dataLoop:
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case inDC, inDC_ok = <-inData:
-		}
-		if !inDC_ok {
-			break
-		}
+func (a *thresholdAcc) Emit(dr datechan.DateIdxRange) []float32 {
+	return thresholdResult(a.config, a.pCnt, a.cnt, dr.Len())
+}
 
-		if inDC.Date.Less(dr.Start) {
-			alog.Debugf("skip %s < %s", inDC.Date.Key(), dr.Start.Key())
-			continue
-		}
-		if inDC.Date.Less(dr.End) || inDC.Date.Equal(dr.End) {
-			if pCnt == nil {
-				pCnt = make([]float32, len(inDC.Data))
-				cnt = make([]int, len(inDC.Data))
-			}
-			switch config.Threshold {
-			case "lt":
-				for idx, v := range inDC.Data {
-					if v == v {
-						cnt[idx]++
-						if v < config.ThresholdValue {
-							pCnt[idx]++
-						}
-					}
-				}
-			case "gt":
-				for idx, v := range inDC.Data {
-					if v == v {
-						cnt[idx]++
-						if v > config.ThresholdValue {
-							pCnt[idx]++
-						}
-					}
-				}
-			case "le":
-				for idx, v := range inDC.Data {
-					if v == v {
-						cnt[idx]++
-						if v <= config.ThresholdValue {
-							pCnt[idx]++
-						}
-					}
-				}
-			case "ge":
-				for idx, v := range inDC.Data {
-					if v == v {
-						cnt[idx]++
-						if v >= config.ThresholdValue {
-							pCnt[idx]++
-						}
-					}
-				}
-			case "eq":
-				for idx, v := range inDC.Data {
-					if v == v {
-						cnt[idx]++
-						if v == config.ThresholdValue {
-							pCnt[idx]++
-						}
-					}
-				}
-			}
-			obsCnt++
-			if firstDC == nil {
-				firstDC = &dataListItem{data: inDC}
-				lastDC = firstDC
-			} else {
-				nextDC := &dataListItem{data: inDC}
-				lastDC.next = nextDC
-				lastDC = nextDC
-			}
-		}
-		if !inDC.Date.Less(dr.End) {
-			for {
-				if err := nextRange(); err != nil {
-					return err
-				}
-				if !dr_ok {
-					break dataLoop
-				}
-				if !dr.End.Less(inDC.Date) {
-					break
-				}
-				alog.Debugf("skip+ %s >= %s", inDC.Date.Key(), dr.End.Key())
-			}
-		}
-	}
+func (a *thresholdAcc) Reset() {
+	a.pCnt = nil
+	a.cnt = nil
+}
 
-	if err := nextRange(); err != nil {
-		return err
-	}
+func Threshold(ctx context.Context,
+	config Config,
+	drc datechan.DateRangeChannel,
+	inData, outData chan griddata.DataChunk) error {
 
-	// drain data channel??
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case inDC, inDC_ok = <-inData:
-			if !inDC_ok {
-				return nil
-			}
-		}
-	}
+	config.Overlapping = false
+	return Accumulate(ctx, config, newThresholdAcc(config), drc, inData, outData)
+}
 
-	return nil
+func ThresholdOverlap(ctx context.Context,
+	config Config,
+	drc datechan.DateRangeChannel,
+	inData, outData chan griddata.DataChunk) error {
+
+	config.Overlapping = true
+	return Accumulate(ctx, config, newThresholdAcc(config), drc, inData, outData)
 }
@@ -0,0 +1,170 @@
+package reduce
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
+)
+
+func TestThresholdPct(t *testing.T) {
+	assert := assert.New(t)
+	cal := &datechan.Gregorian{}
+	ctx := context.Background()
+
+	var elem params.Element
+	jsonBlob := []byte(`{"vX":4, "interval":[0,0,4], "duration":4, "reduce":"pct_gt_32","maxMissing":1}`)
+	err := json.Unmarshal(jsonBlob, &elem)
+	assert.Nil(err)
+	nan := float32(math.NaN())
+	cfg, err := Setup(elem)
+	assert.Nil(err)
+	assert.Equal("pct", cfg.ThresholdType)
+
+	drCfg := datechan.IDconfig{
+		Interval:      elem.DateIterConfig.Interval,
+		Duration:      elem.DateIterConfig.Duration,
+		Sdate:         []int{2000, 1, 4},
+		Edate:         []int{2000, 1, 4},
+		Calendar:      cal,
+		InResolution:  3,
+		OutResolution: 3,
+	}
+	drCfg.Validate()
+	drc := datechan.New(ctx, drCfg)
+
+	inData := make(chan griddata.DataChunk, 10)
+	outData := make(chan griddata.DataChunk, 0)
+
+	inData <- griddata.DataChunk{
+		Date: cal.YMDtoYI([]int{2000, 1, 1}),
+		Data: []float32{33, nan, nan, 0},
+	}
+	inData <- griddata.DataChunk{
+		Date: cal.YMDtoYI([]int{2000, 1, 2}),
+		Data: []float32{30, 40, nan, 0},
+	}
+	inData <- griddata.DataChunk{
+		Date: cal.YMDtoYI([]int{2000, 1, 3}),
+		Data: []float32{35, 20, 50, 0},
+	}
+	inData <- griddata.DataChunk{
+		Date: cal.YMDtoYI([]int{2000, 1, 4}),
+		Data: []float32{32, 10, 50, 0},
+	}
+	close(inData)
+	go func() {
+		err := cfg.Func(ctx, cfg, drc, inData, outData)
+		assert.Nil(err)
+	}()
+	d, ok := <-outData
+	assert.True(ok)
+	assert.Equal(4, len(d.Data))
+	assert.Equal(float32(50), d.Data[0])
+	assert.InDelta(float32(100./3.), d.Data[1], 1e-5)
+	assert.False(d.Data[2] == d.Data[2])
+	assert.Equal(float32(0), d.Data[3])
+}
+
+func TestThresholdOverlap(t *testing.T) {
+	assert := assert.New(t)
+	cal := &datechan.Gregorian{}
+	ctx := context.Background()
+
+	var elem params.Element
+	jsonBlob := []byte(`{"vX":4, "interval":[0,0,1], "duration":3, "reduce":"cnt_ge_2","maxMissing":1}`)
+	err := json.Unmarshal(jsonBlob, &elem)
+	assert.Nil(err)
+	nan := float32(math.NaN())
+	cfg, err := Setup(elem)
+	assert.Nil(err)
+
+	drCfg := datechan.IDconfig{
+		Interval:      elem.DateIterConfig.Interval,
+		Duration:      elem.DateIterConfig.Duration,
+		Sdate:         []int{2000, 1, 3},
+		Edate:         []int{2000, 1, 6},
+		Calendar:      cal,
+		InResolution:  3,
+		OutResolution: 3,
+	}
+	drCfg.Validate()
+	assert.True(drCfg.IsOverlapping())
+	drc := datechan.New(ctx, drCfg)
+
+	inData := make(chan griddata.DataChunk, 10)
+	outData := make(chan griddata.DataChunk, 0)
+
+	days := [][]float32{
+		{1, nan},
+		{5, 4},
+		{2, 4},
+		{3, nan},
+		{1, 1},
+		{0, 2},
+	}
+	for day, data := range days {
+		inData <- griddata.DataChunk{
+			Date: cal.YMDtoYI([]int{2000, 1, day + 1}),
+			Data: data,
+		}
+	}
+	close(inData)
+	go func() {
+		err := cfg.Func(ctx, cfg, drc, inData, outData)
+		assert.Nil(err)
+	}()
+
+	expected := [][]float32{
+		{2, 2},
+		{3, 2},
+		{2, 1},
+		{1, 1},
+	}
+	for _, exp := range expected {
+		d, ok := <-outData
+		assert.True(ok)
+		assert.Equal(exp, d.Data)
+	}
+	_, ok := <-outData
+	assert.False(ok)
+}
+
+func TestThresholdBetween(t *testing.T) {
+	days := [][]float32{{32}, {50}, {40}, {31}}
+	for name, expected := range map[string][][]float32{
+		"cnt_ne_32":     {{3}},
+		"cnt_btw_32_50": {{3}},
+		"cnt_btx_32_50": {{1}},
+		"cnt_bth_32_50": {{2}},
+	} {
+		res := runDaily(t, `{"vX":4, "interval":[0,0,4], "duration":4, "reduce":"`+name+`"}`,
+			[]int{2000, 1, 4}, []int{2000, 1, 4}, days)
+		if assert.Len(t, res, len(expected), name) {
+			for i := range expected {
+				assertData(t, expected[i], res[i], name)
+			}
+		}
+	}
+
+	// overlapping two day windows ending Jan 2, 3 and 4
+	for name, expected := range map[string][][]float32{
+		"cnt_ne_32":     {{1}, {2}, {2}},
+		"cnt_btw_32_50": {{2}, {2}, {1}},
+		"cnt_btx_32_50": {{0}, {1}, {1}},
+		"cnt_bth_32_50": {{1}, {1}, {1}},
+	} {
+		res := runDaily(t, `{"vX":4, "interval":[0,0,1], "duration":2, "reduce":"`+name+`"}`,
+			[]int{2000, 1, 2}, []int{2000, 1, 4}, days)
+		if assert.Len(t, res, len(expected), name) {
+			for i := range expected {
+				assertData(t, expected[i], res[i], name)
+			}
+		}
+	}
+}
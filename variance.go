@@ -0,0 +1,119 @@
+package reduce
+
+import (
+	"math"
+
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+)
+
+func init() {
+	Register("var", "sample variance", AccumulatorFactory(newVarianceAcc))
+	Register("std", "sample standard deviation", AccumulatorFactory(newVarianceAcc))
+	Register("varp", "population variance", AccumulatorFactory(newVarianceAcc))
+	Register("stdp", "population standard deviation", AccumulatorFactory(newVarianceAcc))
+}
+
+// welford holds the running count, mean and sum of squared deviations
+// of one grid cell. Accumulating deviations from the running mean in
+// float64 (Welford's method) avoids the cancellation of sum-of-squares
+// formulas and allows an observation to be taken back out exactly in
+// the reverse order of operations.
+type welford struct {
+	n    int
+	mean float64
+	m2   float64
+}
+
+func (w *welford) add(v float32) {
+	x := float64(v)
+	w.n++
+	d := x - w.mean
+	w.mean += d / float64(w.n)
+	w.m2 += d * (x - w.mean)
+}
+
+func (w *welford) remove(v float32) {
+	if w.n <= 1 {
+		*w = welford{}
+		return
+	}
+	x := float64(v)
+	w.n--
+	d := x - w.mean
+	w.mean -= d / float64(w.n)
+	w.m2 -= d * (x - w.mean)
+	if w.m2 < 0 {
+		w.m2 = 0
+	}
+}
+
+// result returns the variance ("var", "varp") or standard deviation
+// ("std", "stdp") named by name. The plain names are sample statistics
+// (n-1 denominator), the "p" suffixed names population statistics.
+func (w *welford) result(name string) float32 {
+	var v float64
+	switch name {
+	case "var", "std":
+		if w.n < 2 {
+			return float32(math.NaN())
+		}
+		v = w.m2 / float64(w.n-1)
+	default:
+		if w.n < 1 {
+			return float32(math.NaN())
+		}
+		v = w.m2 / float64(w.n)
+	}
+	if name == "std" || name == "stdp" {
+		v = math.Sqrt(v)
+	}
+	return float32(v)
+}
+
+// varianceAcc keeps the Welford state of each cell.
+type varianceAcc struct {
+	config Config
+	acc    []welford
+}
+
+func newVarianceAcc(config Config) Accumulator {
+	return &varianceAcc{config: config}
+}
+
+func (a *varianceAcc) Add(dr datechan.DateIdxRange, dc griddata.DataChunk) {
+	if a.acc == nil {
+		a.acc = make([]welford, len(dc.Data))
+	}
+	for idx, v := range dc.Data {
+		if v == v {
+			a.acc[idx].add(v)
+		}
+	}
+}
+
+func (a *varianceAcc) Remove(dc griddata.DataChunk) {
+	for idx, v := range dc.Data {
+		if v == v {
+			a.acc[idx].remove(v)
+		}
+	}
+}
+
+func (a *varianceAcc) Emit(dr datechan.DateIdxRange) []float32 {
+	nan := float32(math.NaN())
+	expCnt := dr.Len()
+	res := make([]float32, len(a.acc))
+	for idx := range a.acc {
+		if expCnt-a.acc[idx].n <= a.config.MaxMissing {
+			res[idx] = a.acc[idx].result(a.config.Name)
+		} else {
+			res[idx] = nan
+		}
+	}
+	return res
+}
+
+func (a *varianceAcc) Reset() {
+	a.acc = nil
+}
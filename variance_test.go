@@ -0,0 +1,68 @@
+package reduce
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVariance(t *testing.T) {
+	nan := float32(math.NaN())
+
+	var days [][]float32
+	for _, v := range []float32{2, 4, 4, 4, 5, 5, 7, 9} {
+		days = append(days, []float32{v, 1, nan})
+	}
+	days[3][2] = 3
+	for name, expected := range map[string][]float32{
+		"var":  {32. / 7, 0, nan},
+		"std":  {float32(math.Sqrt(32. / 7)), 0, nan},
+		"varp": {4, 0, 0},
+		"stdp": {2, 0, 0},
+	} {
+		res := runDaily(t, `{"vX":4, "interval":[0,0,8], "duration":8, "reduce":"`+name+`","maxMissing":7}`,
+			[]int{2000, 1, 8}, []int{2000, 1, 8}, days)
+		if assert.Len(t, res, 1, name) {
+			assertData(t, expected, res[0], name)
+		}
+	}
+
+	// values leaving two day windows
+	days = [][]float32{{1}, {100}, {2}, {3}}
+	res := runDaily(t, `{"vX":4, "interval":[0,0,1], "duration":2, "reduce":"var"}`,
+		[]int{2000, 1, 2}, []int{2000, 1, 4}, days)
+	if assert.Len(t, res, 3) {
+		assertData(t, []float32{4900.5}, res[0], "Jan 2")
+		assertData(t, []float32{4802}, res[1], "Jan 3")
+		assertData(t, []float32{0.5}, res[2], "Jan 4")
+	}
+}
+
+func TestVarianceLongWindow(t *testing.T) {
+	assert := assert.New(t)
+
+	// a large mean and small spread, over 50 day windows
+	const n, window = 400, 50
+	days := make([][]float32, n)
+	for i := range days {
+		days[i] = []float32{1e5 + float32(i%7) + float32(i%3)/4}
+	}
+	res := runDaily(t, `{"vX":4, "interval":[0,0,1], "duration":50, "reduce":"std"}`,
+		[]int{2000, 1, window}, []int{2000, 1, n}, days)
+	if !assert.Len(res, n-window+1) {
+		return
+	}
+	for end, data := range res {
+		vals := days[end : end+window]
+		var mean, m2 float64
+		for _, v := range vals {
+			mean += float64(v[0])
+		}
+		mean /= window
+		for _, v := range vals {
+			m2 += (float64(v[0]) - mean) * (float64(v[0]) - mean)
+		}
+		assert.InDelta(math.Sqrt(m2/(window-1)), data[0], 1e-4, "window %d", end)
+	}
+}
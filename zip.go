@@ -0,0 +1,109 @@
+package reduce
+
+import (
+	"context"
+	"fmt"
+
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+)
+
+// Zip merges the chunks of inputs, read in step, into the chunks of
+// outData, which it closes on return. The chunks read together must
+// have the same Date, Offset, Length and number of values; the merged
+// chunk holds the data of each input in turn, Data[i*n:(i+1)*n] being
+// the data of input i for chunks of n values. Chunks that do not line
+// up, or inputs ending before the others, are reported as errors.
+func Zip(ctx context.Context,
+	inputs []chan griddata.DataChunk,
+	outData chan griddata.DataChunk) error {
+
+	defer close(outData)
+
+	chunks := make([]griddata.DataChunk, len(inputs))
+	for {
+		var (
+			inDC_ok bool
+			closed  int
+		)
+		for i, in := range inputs {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case chunks[i], inDC_ok = <-in:
+			}
+			if !inDC_ok {
+				closed++
+			}
+		}
+		if closed == len(inputs) {
+			return nil
+		}
+		if closed > 0 {
+			return fmt.Errorf("inputs end at different dates")
+		}
+
+		first := chunks[0]
+		outDC := griddata.DataChunk{
+			Date:   first.Date,
+			Offset: first.Offset,
+			Length: first.Length,
+			Data:   make([]float32, 0, len(inputs)*len(first.Data))}
+		for i, inDC := range chunks {
+			if !inDC.Date.Equal(first.Date) {
+				return fmt.Errorf("input %d date %s does not match %s", i, inDC.Date.Key(), first.Date.Key())
+			}
+			if inDC.Offset != first.Offset || inDC.Length != first.Length ||
+				len(inDC.Data) != len(first.Data) {
+				return fmt.Errorf("input %d chunk at %s does not match", i, inDC.Date.Key())
+			}
+			outDC.Data = append(outDC.Data, inDC.Data...)
+		}
+
+		select {
+		case outData <- outDC:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// RunMulti runs the reduction of config, which takes config.Vars input
+// variables, over the chunks of inputs merged by Zip, one input per
+// variable. An error of Zip, such as disagreeing dates, is returned in
+// preference to that of the reduction.
+func RunMulti(ctx context.Context,
+	config Config,
+	drc datechan.DateRangeChannel,
+	inputs []chan griddata.DataChunk,
+	outData chan griddata.DataChunk) error {
+
+	nvars := config.Vars
+	if nvars < 1 {
+		nvars = 1
+	}
+	if len(inputs) != nvars {
+		close(outData)
+		return fmt.Errorf("reduction takes %d inputs", nvars)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	zipped := make(chan griddata.DataChunk)
+	errc := make(chan error, 1)
+	go func() {
+		err := Zip(ctx, inputs, zipped)
+		if err != nil {
+			cancel()
+		}
+		errc <- err
+	}()
+
+	err := config.Func(ctx, config, drc, zipped, outData)
+	cancel()
+	if zerr := <-errc; zerr != nil && zerr != context.Canceled {
+		return zerr
+	}
+	return err
+}
@@ -0,0 +1,93 @@
+package reduce
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/bnoon/datechan"
+	"gitlab.com/bnoon/griddata"
+	"gitlab.com/bnoon/griddata/params"
+)
+
+func TestRunMulti(t *testing.T) {
+	assert := assert.New(t)
+	cal := &datechan.Gregorian{}
+	ctx := context.Background()
+	nan := float32(math.NaN())
+
+	// precipitation on days with tmax below freezing
+	var elem params.Element
+	jsonBlob := []byte(`{"vX":4, "interval":[0,0,4], "duration":4, "reduce":"sum(v1 * (v2 < 32))","maxMissing":2}`)
+	err := json.Unmarshal(jsonBlob, &elem)
+	assert.Nil(err)
+	cfg, err := Setup(elem)
+	assert.Nil(err)
+	assert.Equal(2, cfg.Vars)
+
+	pcpn := [][]float32{
+		{0.5, 0.1},
+		{0.2, nan},
+		{0, 0.3},
+		{1, 0.4},
+	}
+	tmax := [][]float32{
+		{30, 40},
+		{35, 20},
+		{20, 31},
+		{31, nan},
+	}
+
+	for _, shift := range []int{0, 1} {
+		drCfg := datechan.IDconfig{
+			Interval:      elem.DateIterConfig.Interval,
+			Duration:      elem.DateIterConfig.Duration,
+			Sdate:         []int{2000, 1, 4},
+			Edate:         []int{2000, 1, 4},
+			Calendar:      cal,
+			InResolution:  3,
+			OutResolution: 3,
+		}
+		drCfg.Validate()
+		drc := datechan.New(ctx, drCfg)
+
+		inputs := []chan griddata.DataChunk{
+			make(chan griddata.DataChunk, 10),
+			make(chan griddata.DataChunk, 10),
+		}
+		outData := make(chan griddata.DataChunk, 0)
+		for day := range pcpn {
+			inputs[0] <- griddata.DataChunk{
+				Date: cal.YMDtoYI([]int{2000, 1, day + 1}),
+				Data: pcpn[day],
+			}
+			inputs[1] <- griddata.DataChunk{
+				Date: cal.YMDtoYI([]int{2000, 1, day + 1 + shift}),
+				Data: tmax[day],
+			}
+		}
+		close(inputs[0])
+		close(inputs[1])
+
+		errc := make(chan error, 1)
+		go func() {
+			errc <- RunMulti(ctx, cfg, drc, inputs, outData)
+		}()
+
+		if shift == 0 {
+			d, ok := <-outData
+			assert.True(ok)
+			assert.Equal(float32(1.5), d.Data[0])
+			assert.Equal(float32(0.3), d.Data[1])
+		}
+		_, ok := <-outData
+		assert.False(ok)
+		if shift == 0 {
+			assert.Nil(<-errc)
+		} else {
+			assert.NotNil(<-errc)
+		}
+	}
+}